@@ -31,6 +31,7 @@ const (
 	defaultPrometheusConfigPath = "/etc/prometurbo/prometheus.config"
 	defaultTopologyConfigPath   = "/etc/prometurbo/businessapp.config"
 	defaultWorkerCount          = 4
+	defaultTaskTimeout          = 5 * time.Minute
 )
 
 var (
@@ -38,6 +39,10 @@ var (
 	workerCount              int
 	prometheusConfigFileName string
 	topologyConfigFileName   string
+	discoveryTimeout         time.Duration
+	taskTimeout              time.Duration
+	discoveryInterval        time.Duration
+	maxSnapshotAge           time.Duration
 	// custom resource scheme for controller runtime client
 	customScheme = runtime.NewScheme()
 )
@@ -50,6 +55,14 @@ func parseFlags() {
 		defaultTopologyConfigPath, "path to the topology config file")
 	flag.IntVar(&workerCount, "workerCount", defaultWorkerCount, "the number of concurrent workers to"+
 		"discover metrics")
+	flag.DurationVar(&discoveryTimeout, "discoveryTimeout", 0, "the maximum duration of a discovery, after "+
+		"which the outstanding queries are cancelled and the partial results are returned (default no limit)")
+	flag.DurationVar(&taskTimeout, "taskTimeout", defaultTaskTimeout, "the maximum duration of a discovery "+
+		"task, after which its outstanding queries are cancelled, 0 for no limit")
+	flag.DurationVar(&discoveryInterval, "discoveryInterval", 0, "the interval of the discovery in the "+
+		"background, whose last result is served from memory (default discovery on every request)")
+	flag.DurationVar(&maxSnapshotAge, "maxSnapshotAge", 0, "the maximum age of the result of the background "+
+		"discovery, after which an error is returned instead (default three discovery intervals)")
 	flag.Parse()
 }
 
@@ -93,17 +106,27 @@ func main() {
 		glog.V(2).Infof("Number of concurrent workers to discover metrics: %v", workerCount)
 	}
 
-	server.NewServer(port).
-		MetricProvider(getMetricProvider()).
+	metricProvider, fromConfigMap := getMetricProvider()
+	s := server.NewServer(port).
+		MetricProvider(metricProvider).
 		Topology(topology.NewBusinessTopology(getBizAppsConfig())).
-		Dispatcher(worker.NewDispatcher(workerCount).
-			WithCollector(worker.NewCollector(workerCount * 2))).
-		Run()
+		Dispatcher(worker.NewDispatcher(workerCount).WithTaskTimeout(taskTimeout)).
+		DiscoveryTimeout(discoveryTimeout).
+		DiscoveryInterval(discoveryInterval).
+		MaxSnapshotAge(maxSnapshotAge)
+
+	// Reload the configuration files on change. The custom resources are watched by the provider itself.
+	if fromConfigMap {
+		watchPrometheusConfig(s)
+	}
+	watchBizAppsConfig(s)
+
+	s.Run()
 
 	return
 }
 
-func getMetricProvider() (metricProvider provider.MetricProvider) {
+func getMetricProvider() (metricProvider provider.MetricProvider, fromConfigMap bool) {
 	// For turbo-on-turbo use case, we still use configMap to define prometheus query mappings.
 	// We also support configuring the servers/exporters in helm-chart configmap template.
 	// We also need to make sure that if either the servers or exporter fields are not configured (empty)
@@ -111,6 +134,7 @@ func getMetricProvider() (metricProvider provider.MetricProvider) {
 	configMapMetricProvider, err := configmap.GetMetricProvider(prometheusConfigFileName) //config map is mounted as 'prometheus.config' file
 	if err == nil {
 		metricProvider = configMapMetricProvider
+		fromConfigMap = true
 	} else {
 		// if we cannot read the config file, or if either the servers/exporter config is missing
 		// look at the turbo-metrics CRs
@@ -124,7 +148,7 @@ func getMetricProvider() (metricProvider provider.MetricProvider) {
 	return
 }
 
-func createKubeClientOrDie() client.Client {
+func createKubeClientOrDie() client.WithWatch {
 	kubeConfig, err := rest.InClusterConfig()
 	if err != nil {
 		glog.Fatalf("Fatal error: failed to get in-cluster config: %v.", err)
@@ -132,7 +156,7 @@ func createKubeClientOrDie() client.Client {
 	// This specifies the number and the max number of query per second to the api server.
 	kubeConfig.QPS = 20.0
 	kubeConfig.Burst = 30
-	kubeClient, err := client.New(kubeConfig, client.Options{Scheme: customScheme})
+	kubeClient, err := client.NewWithWatch(kubeConfig, client.Options{Scheme: customScheme})
 	if err != nil {
 		glog.Fatalf("Failed to create controller runtime client: %v.", err)
 	}
@@ -150,6 +174,43 @@ func getBizAppsConfig() []config.BusinessApplication {
 	return bizApps
 }
 
+// watchPrometheusConfig replaces the metric provider of the server when the metrics discovery configuration
+// changes. The last valid configuration is kept if the new one cannot be loaded.
+func watchPrometheusConfig(s *server.Server) {
+	err := config.WatchFile(prometheusConfigFileName, func() {
+		metricProvider, err := configmap.GetMetricProvider(prometheusConfigFileName)
+		if err != nil {
+			glog.Errorf("Failed to reload metrics discovery configuration from %v, "+
+				"keep using the last valid configuration: %v.", prometheusConfigFileName, err)
+			return
+		}
+		s.MetricProvider(metricProvider)
+		glog.Infof("Reloaded metrics discovery configuration from %v.", prometheusConfigFileName)
+	})
+	if err != nil {
+		glog.Errorf("Metrics discovery configuration will not be reloaded on change: %v.", err)
+	}
+}
+
+// watchBizAppsConfig replaces the business topology of the server when the topology configuration changes.
+// The last valid configuration is kept if the new one cannot be loaded.
+func watchBizAppsConfig(s *server.Server) {
+	err := config.WatchFile(topologyConfigFileName, func() {
+		bizApps, err := config.NewBusinessApplicationConfigMap(topologyConfigFileName)
+		if err != nil {
+			glog.Errorf("Failed to reload topology configuration from %v, "+
+				"keep using the last valid configuration: %v.", topologyConfigFileName, err)
+			return
+		}
+		s.Topology(topology.NewBusinessTopology(bizApps))
+		glog.Infof("Reloaded topology configuration from %v.", topologyConfigFileName)
+		glog.V(2).Infof("Business application topology configuration: %s", spew.Sdump(bizApps))
+	})
+	if err != nil {
+		glog.Errorf("Topology configuration will not be reloaded on change: %v.", err)
+	}
+}
+
 func WatchConfigMap() {
 	//Check if the /etc/prometurbo/turbo-autoreload.config exists
 	autoReloadConfigFilePath := "/etc/prometurbo"
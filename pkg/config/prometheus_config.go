@@ -20,10 +20,80 @@ type ServerConfig struct {
 	ClusterId   string   `yaml:"clusterId"`
 	BearerToken string   `yaml:"bearerToken"`
 	Exporters   []string `yaml:"exporters"`
+	// File of the bearer token, read again when the token is rotated, e.g. a projected service account token.
+	// It takes precedence over BearerToken.
+	BearerTokenFile string `yaml:"bearerTokenFile,omitempty"`
+	// OAuth2 client credentials that the bearer token is obtained with, instead of BearerToken
+	OAuth2 *OAuth2Config `yaml:"oauth2,omitempty"`
+	// AWS Signature Version 4 signing of the requests, e.g. for Amazon Managed Service for Prometheus
+	SigV4 *SigV4Config `yaml:"sigv4,omitempty"`
+	// Timeout of each attempt of a query, e.g. 30s
+	Timeout string `yaml:"timeout,omitempty"`
+	// Number of times a query is retried after a connection error, a timeout, a 5xx or a 429 status
+	MaxRetries     *int                  `yaml:"maxRetries,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker,omitempty"`
+	// Limits of the queries sent to the server by all tasks, no limit if 0
+	MaxConcurrentQueries int     `yaml:"maxConcurrentQueries,omitempty"`
+	QueriesPerSecond     float64 `yaml:"queriesPerSecond,omitempty"`
+	// Samples older than this age are dropped, e.g. 5m
+	MaxSampleAge string     `yaml:"maxSampleAge,omitempty"`
+	TLS          *TLSConfig `yaml:"tls,omitempty"`
+	// Additional headers of the requests, e.g. X-Scope-OrgID for a multi-tenant backend
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Additional headers whose values are read from files, e.g. mounted from Secrets
+	HeaderFiles map[string]string `yaml:"headerFiles,omitempty"`
+	// Tenants of a multi-tenant backend, each discovered as its own cluster; the server is queried without
+	// tenant headers if empty
+	Tenants []TenantConfig `yaml:"tenants,omitempty"`
+}
+
+// TenantConfig is a tenant of a multi-tenant backend, whose queries are sent with the tenant headers in
+// addition to the headers of the server
+type TenantConfig struct {
+	ClusterId   string            `yaml:"clusterId"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	HeaderFiles map[string]string `yaml:"headerFiles,omitempty"`
+}
+
+// TLSConfig configures the TLS connections to a server. The server certificate is verified against the system
+// CAs unless a CA file is given, or unless the verification is explicitly skipped.
+type TLSConfig struct {
+	CAFile             string `yaml:"caFile,omitempty"`             // PEM CA bundle to verify the server certificate
+	CertFile           string `yaml:"certFile,omitempty"`           // PEM client certificate for mutual TLS
+	KeyFile            string `yaml:"keyFile,omitempty"`            // PEM key of the client certificate
+	ServerName         string `yaml:"serverName,omitempty"`         // Name to verify the server certificate against
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"` // Skip the verification, not recommended
+}
+
+// OAuth2Config obtains the access tokens of the requests from a token endpoint with the client credentials grant
+type OAuth2Config struct {
+	TokenURL         string   `yaml:"tokenUrl"`                   // Token endpoint of the OAuth2 provider
+	ClientID         string   `yaml:"clientId"`                   // Client ID
+	ClientSecret     string   `yaml:"clientSecret,omitempty"`     // Client secret
+	ClientSecretFile string   `yaml:"clientSecretFile,omitempty"` // File of the client secret, e.g. mounted from a Secret
+	Scopes           []string `yaml:"scopes,omitempty"`           // Scopes of the access token
+}
+
+// SigV4Config signs the requests with AWS Signature Version 4. The static keys are optional: the credentials of
+// the environment, or the web identity of the IAM role of the service account, are used without them.
+type SigV4Config struct {
+	Region              string `yaml:"region"`                        // Region of the workspace
+	AccessKeyID         string `yaml:"accessKeyId,omitempty"`         // Static access key ID
+	SecretAccessKey     string `yaml:"secretAccessKey,omitempty"`     // Static secret access key
+	SecretAccessKeyFile string `yaml:"secretAccessKeyFile,omitempty"` // File of the secret access key
+	RoleARN             string `yaml:"roleArn,omitempty"`             // Role to assume
+}
+
+// CircuitBreakerConfig stops querying a server for a cooldown period after consecutive failures
+type CircuitBreakerConfig struct {
+	FailureThreshold *int   `yaml:"failureThreshold,omitempty"` // Consecutive failures to open the breaker, 0 to disable it
+	Cooldown         string `yaml:"cooldown,omitempty"`         // Time before querying the server again, e.g. 2m
 }
 
 type ExporterConfig struct {
 	EntityConfigs []EntityConfig `yaml:"entities"`
+	// Samples older than this age are dropped, overriding the maximum age of the server, e.g. 5m
+	MaxSampleAge string `yaml:"maxSampleAge,omitempty"`
 }
 
 type EntityConfig struct {
@@ -31,11 +101,46 @@ type EntityConfig struct {
 	HostedOnVM       bool                    `yaml:"hostedOnVM,omitempty"`
 	MetricConfigs    []MetricConfig          `yaml:"metrics"`
 	AttributeConfigs map[string]ValueMapping `yaml:"attributes"`
+	EnrichConfigs    []EnrichConfig          `yaml:"enrich,omitempty"`
+}
+
+// EnrichConfig joins the labels of the series of an auxiliary query, e.g. kube_pod_info, onto the series of the
+// metric queries that have the same values of the join labels, before the attributes are extracted
+type EnrichConfig struct {
+	Query  string   `yaml:"query"`
+	On     []string `yaml:"on"`               // Join labels, e.g. [namespace, pod]
+	Labels []string `yaml:"labels,omitempty"` // Labels to add, e.g. [pod_ip]; all labels but the name and the On labels if empty
 }
 
 type MetricConfig struct {
 	Type    string            `yaml:"type"`
 	Queries map[string]string `yaml:"queries"`
+	Range   *RangeConfig      `yaml:"range,omitempty"`
+	// Aggregation reduces the samples of each series in a matrix result, one of avg (default), sum, min, max
+	// or last
+	Aggregation string `yaml:"aggregation,omitempty"`
+	// SeriesAggregation reduces the values of the series that map to the same entity, one of max (default),
+	// sum, avg, min or last
+	SeriesAggregation string `yaml:"seriesAggregation,omitempty"`
+	// Key is the name of the label or attribute whose value becomes the commodity key, or a template
+	// referencing them as $name or ${name}, e.g. "${queue}@${namespace}"
+	Key string `yaml:"key,omitempty"`
+	// Unit of the metric values after conversion, one of count, tps, ms, mb, mhz or pct
+	Unit string `yaml:"unit,omitempty"`
+	// Conversion is a named conversion of the values, e.g. bytesToMB, secondsToMs or ratioToPct
+	Conversion string `yaml:"conversion,omitempty"`
+	// Scale and Offset convert the values as value*scale + offset; they cannot be combined with a conversion
+	Scale  *float64 `yaml:"scale,omitempty"`
+	Offset float64  `yaml:"offset,omitempty"`
+}
+
+// RangeConfig evaluates the used query over a time window instead of at a single instant, and reports the
+// average, minimum and maximum of the samples in the window. With a percentile, the percentile of the samples
+// replaces their maximum as the max value, and the maximum sample is not reported.
+type RangeConfig struct {
+	Window     string  `yaml:"window"`               // Time window to query, e.g. 10m
+	Step       string  `yaml:"step"`                 // Resolution step of the samples in the window, e.g. 30s
+	Percentile float64 `yaml:"percentile,omitempty"` // Percentile of the samples reported as max, e.g. 95
 }
 
 type ValueMapping struct {
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// WatchFile watches a configuration file and calls onChange every time the file is modified.
+// The parent directory is watched instead of the file itself, because files mounted from a ConfigMap are
+// replaced by swapping the symbolic link of the data directory, which is not reported as an event of the file.
+func WatchFile(path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher for %v: %v", path, err)
+	}
+	configFile := filepath.Clean(path)
+	configDir, _ := filepath.Split(configFile)
+	if err := watcher.Add(configDir); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("failed to watch directory %v: %v", configDir, err)
+	}
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				// Only react when the file itself is written or created, or when its real path has changed
+				fileChanged := filepath.Clean(event.Name) == configFile &&
+					(event.Has(fsnotify.Write) || event.Has(fsnotify.Create))
+				linkChanged := currentConfigFile != "" && currentConfigFile != realConfigFile
+				if fileChanged || linkChanged {
+					realConfigFile = currentConfigFile
+					glog.V(2).Infof("Detected change of configuration file %v: %v.", configFile, event)
+					onChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Errorf("Error watching configuration file %v: %v.", configFile, err)
+			}
+		}
+	}()
+	glog.V(1).Infof("Start watching configuration file %v.", configFile)
+	return nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchFileWithSymlinkSwap(t *testing.T) {
+	// Simulate the layout of a ConfigMap volume:
+	// prometheus.config -> ..data/prometheus.config, ..data -> ..v1
+	dir := t.TempDir()
+	for _, version := range []string{"..v1", "..v2"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, version), 0755))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, version, "prometheus.config"), []byte(version), 0644))
+	}
+	assert.Nil(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	assert.Nil(t, os.Symlink(filepath.Join("..data", "prometheus.config"), filepath.Join(dir, "prometheus.config")))
+
+	changed := make(chan struct{}, 10)
+	assert.Nil(t, WatchFile(filepath.Join(dir, "prometheus.config"), func() {
+		changed <- struct{}{}
+	}))
+	// Atomically swap the data directory
+	assert.Nil(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+	assert.Nil(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change of configuration file is not detected")
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "prometheus.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, "..v2", string(content))
+}
+
+func TestWatchFileWithMissingDirectory(t *testing.T) {
+	assert.NotNil(t, WatchFile(filepath.Join(t.TempDir(), "missing", "prometheus.config"), func() {}))
+}
@@ -0,0 +1,243 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Credentials are refreshed this period before they expire
+	awsCredentialsExpiryDelta = 5 * time.Minute
+	// Timeout of a request to STS
+	stsTimeout = 30 * time.Second
+	// Session name of the assumed roles, which appears in the CloudTrail logs of the account
+	stsRoleSessionName = "prometurbo"
+	stsAPIVersion      = "2011-06-15"
+	// Environment variables of the credentials, and of the web identity of the IAM roles for service accounts
+	envAWSAccessKeyID          = "AWS_ACCESS_KEY_ID"
+	envAWSSecretAccessKey      = "AWS_SECRET_ACCESS_KEY"
+	envAWSSessionToken         = "AWS_SESSION_TOKEN"
+	envAWSRoleARN              = "AWS_ROLE_ARN"
+	envAWSWebIdentityTokenFile = "AWS_WEB_IDENTITY_TOKEN_FILE"
+)
+
+// awsCredentials are the credentials that the requests are signed with; they do not expire if Expiry is zero
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiry          time.Time
+}
+
+// awsCredentialsCache caches the credentials until shortly before they expire
+type awsCredentialsCache struct {
+	fetch func(ctx context.Context) (awsCredentials, error)
+	// Held while the credentials are read or fetched; a channel so that the callers stop waiting when their
+	// context is done
+	lock    chan struct{}
+	current *awsCredentials
+}
+
+func newAWSCredentialsCache(fetch func(ctx context.Context) (awsCredentials, error)) *awsCredentialsCache {
+	return &awsCredentialsCache{fetch: fetch, lock: make(chan struct{}, 1)}
+}
+
+// get returns the cached credentials, or fetches them within the context
+func (c *awsCredentialsCache) get(ctx context.Context) (awsCredentials, error) {
+	select {
+	case c.lock <- struct{}{}:
+	case <-ctx.Done():
+		return awsCredentials{}, fmt.Errorf("AWS credentials are not obtained in time: %w", ctx.Err())
+	}
+	defer func() { <-c.lock }()
+	if c.current != nil &&
+		(c.current.Expiry.IsZero() || time.Now().Add(awsCredentialsExpiryDelta).Before(c.current.Expiry)) {
+		return *c.current, nil
+	}
+	credentials, err := c.fetch(ctx)
+	if err != nil {
+		if c.current != nil && time.Now().Before(c.current.Expiry) {
+			glog.Warningf("Failed to refresh AWS credentials, keep using the last credentials until %v: %v.",
+				c.current.Expiry, err)
+			return *c.current, nil
+		}
+		return awsCredentials{}, err
+	}
+	c.current = &credentials
+	return credentials, nil
+}
+
+// newAWSCredentials resolves the credentials of the SigV4 configuration, and returns them with the identity
+// that the requests are signed as
+func newAWSCredentials(config SigV4Config) (*awsCredentialsCache, string, error) {
+	if (config.AccessKeyID == "") != (config.SecretAccessKey == "") {
+		return nil, "", fmt.Errorf("both the access key ID and the secret access key are required")
+	}
+	stsEndpoint := config.STSEndpoint
+	if stsEndpoint == "" {
+		stsEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", config.Region)
+	}
+	sts := &stsClient{endpoint: stsEndpoint, region: config.Region, client: &http.Client{Timeout: stsTimeout}}
+
+	var base func(ctx context.Context) (awsCredentials, error)
+	var identity string
+	switch {
+	case config.AccessKeyID != "":
+		static := awsCredentials{
+			AccessKeyID:     config.AccessKeyID,
+			SecretAccessKey: config.SecretAccessKey,
+			SessionToken:    config.SessionToken,
+		}
+		base = func(context.Context) (awsCredentials, error) { return static, nil }
+		identity = config.AccessKeyID
+	case os.Getenv(envAWSAccessKeyID) != "" && os.Getenv(envAWSSecretAccessKey) != "":
+		env := awsCredentials{
+			AccessKeyID:     os.Getenv(envAWSAccessKeyID),
+			SecretAccessKey: os.Getenv(envAWSSecretAccessKey),
+			SessionToken:    os.Getenv(envAWSSessionToken),
+		}
+		base = func(context.Context) (awsCredentials, error) { return env, nil }
+		identity = env.AccessKeyID
+	case os.Getenv(envAWSWebIdentityTokenFile) != "":
+		// The web identity assumes the configured role directly, or the role of the service account
+		roleARN := config.RoleARN
+		if roleARN == "" {
+			roleARN = os.Getenv(envAWSRoleARN)
+		}
+		if roleARN == "" {
+			return nil, "", fmt.Errorf("missing role ARN of the web identity")
+		}
+		tokenFile := os.Getenv(envAWSWebIdentityTokenFile)
+		return newAWSCredentialsCache(func(ctx context.Context) (awsCredentials, error) {
+			return sts.assumeRoleWithWebIdentity(ctx, roleARN, tokenFile)
+		}), roleARN, nil
+	default:
+		return nil, "", fmt.Errorf("no AWS credentials in the configuration or in the environment")
+	}
+	if config.RoleARN == "" {
+		return newAWSCredentialsCache(base), identity, nil
+	}
+	baseCache := newAWSCredentialsCache(base)
+	return newAWSCredentialsCache(func(ctx context.Context) (awsCredentials, error) {
+		credentials, err := baseCache.get(ctx)
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		return sts.assumeRole(ctx, config.RoleARN, credentials)
+	}), config.RoleARN, nil
+}
+
+// stsClient obtains the temporary credentials of a role from the AWS Security Token Service
+type stsClient struct {
+	endpoint string
+	region   string
+	client   *http.Client
+}
+
+// stsCredentials are the credentials in the result of AssumeRole and AssumeRoleWithWebIdentity
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+type stsResponse struct {
+	AssumeRoleResult struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleResult"`
+	AssumeRoleWithWebIdentityResult struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+type stsErrorResponse struct {
+	Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// assumeRole obtains the credentials of the role with the credentials of the caller
+func (c *stsClient) assumeRole(ctx context.Context, roleARN string,
+	credentials awsCredentials) (awsCredentials, error) {
+	return c.call(ctx, url.Values{
+		"Action":          {"AssumeRole"},
+		"RoleArn":         {roleARN},
+		"RoleSessionName": {stsRoleSessionName},
+	}, &credentials)
+}
+
+// assumeRoleWithWebIdentity obtains the credentials of the role with the web identity token in the file, which
+// is read again every time as the token is rotated
+func (c *stsClient) assumeRoleWithWebIdentity(ctx context.Context, roleARN, tokenFile string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read web identity token: %v", err)
+	}
+	return c.call(ctx, url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {stsRoleSessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}, nil)
+}
+
+// call sends the request to STS within the context, signed with the credentials unless they are nil
+func (c *stsClient) call(ctx context.Context, params url.Values, credentials *awsCredentials) (awsCredentials, error) {
+	params.Set("Version", stsAPIVersion)
+	ctx, cancel := context.WithTimeout(ctx, stsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to create STS request to %v: %v", c.endpoint, err)
+	}
+	if credentials != nil {
+		signV4(req, *credentials, c.region, "sts", time.Now().UTC())
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to send STS request to %v: %w", c.endpoint, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read STS response from %v: %v", c.endpoint, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp stsErrorResponse
+		if xml.Unmarshal(body, &errResp) == nil && errResp.Error.Code != "" {
+			return awsCredentials{}, fmt.Errorf("%v of %v failed with status %d: %v: %v", params.Get("Action"),
+				params.Get("RoleArn"), resp.StatusCode, errResp.Error.Code, errResp.Error.Message)
+		}
+		return awsCredentials{}, fmt.Errorf("%v of %v failed with status %d: %s", params.Get("Action"),
+			params.Get("RoleArn"), resp.StatusCode, body)
+	}
+	var stsResp stsResponse
+	if err := xml.Unmarshal(body, &stsResp); err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to decode STS response from %v: %v", c.endpoint, err)
+	}
+	result := stsResp.AssumeRoleResult.Credentials
+	if result.AccessKeyID == "" {
+		result = stsResp.AssumeRoleWithWebIdentityResult.Credentials
+	}
+	if result.AccessKeyID == "" || result.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no credentials in the STS response from %v", c.endpoint)
+	}
+	glog.V(3).Infof("Assumed role %v until %v.", params.Get("RoleArn"), result.Expiration)
+	return awsCredentials{
+		AccessKeyID:     result.AccessKeyID,
+		SecretAccessKey: result.SecretAccessKey,
+		SessionToken:    result.SessionToken,
+		Expiry:          result.Expiration,
+	}, nil
+}
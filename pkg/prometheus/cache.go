@@ -0,0 +1,135 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// QueryCache caches the results of the queries sent to the Prometheus servers within a discovery cycle.
+// Identical queries sent to the same server, e.g. by different exporters or by multiple cluster configurations
+// pointing at one server, share a single round trip: the first caller sends the query, and the concurrent and
+// subsequent callers wait for and reuse its result, including its error.
+//
+// The shared query is sent within the context of the discovery cycle rather than the one of the first caller,
+// and each caller stops waiting for the result when its own context is done. A query that is cancelled or
+// times out is not cached, so that the next caller sends it again.
+//
+// A QueryCache must only be used for one discovery cycle. A nil QueryCache sends every query to the server.
+type QueryCache struct {
+	// Context of the discovery cycle, within which the queries are sent
+	ctx    context.Context
+	lock   sync.Mutex
+	calls  map[queryKey]*queryCall
+	hits   int
+	misses int
+}
+
+type queryKey struct {
+	server string
+	query  string
+	// window and step are zero for instant queries
+	window time.Duration
+	step   time.Duration
+}
+
+type queryCall struct {
+	done   chan struct{}
+	result []MetricData
+	err    error
+}
+
+// NewQueryCache creates the cache of a discovery cycle, whose queries are sent within the context
+func NewQueryCache(ctx context.Context) *QueryCache {
+	return &QueryCache{
+		ctx:   ctx,
+		calls: map[queryKey]*queryCall{},
+	}
+}
+
+// GetMetrics returns the cached result of the instant query to the server of the client, or sends the query
+// with RestClient.GetMetrics if it is not cached. The returned MetricData are shared and must not be modified.
+func (qc *QueryCache) GetMetrics(ctx context.Context, c *RestClient, query string) ([]MetricData, error) {
+	if qc == nil {
+		return c.GetMetrics(ctx, query)
+	}
+	return qc.do(ctx, queryKey{server: c.serverKey(), query: query}, func(ctx context.Context) ([]MetricData, error) {
+		return c.GetMetrics(ctx, query)
+	})
+}
+
+// GetRangeMetrics returns the cached result of the range query to the server of the client, or sends the
+// query with RestClient.GetRangeMetrics if it is not cached. The returned MetricData are shared and must not
+// be modified.
+func (qc *QueryCache) GetRangeMetrics(ctx context.Context, c *RestClient, query string,
+	window, step time.Duration) ([]MetricData, error) {
+	if qc == nil {
+		return c.GetRangeMetrics(ctx, query, window, step)
+	}
+	key := queryKey{server: c.serverKey(), query: query, window: window, step: step}
+	return qc.do(ctx, key, func(ctx context.Context) ([]MetricData, error) {
+		return c.GetRangeMetrics(ctx, query, window, step)
+	})
+}
+
+// Stats returns the number of queries answered from the cache, and the number of queries sent to the servers
+func (qc *QueryCache) Stats() (hits, misses int) {
+	if qc == nil {
+		return 0, 0
+	}
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	return qc.hits, qc.misses
+}
+
+// do returns the result of the call of the key, or starts the call with fetch if there is none. The caller
+// waits for the result until its context is done.
+func (qc *QueryCache) do(ctx context.Context, key queryKey,
+	fetch func(ctx context.Context) ([]MetricData, error)) ([]MetricData, error) {
+	qc.lock.Lock()
+	call, found := qc.calls[key]
+	if found {
+		qc.hits++
+	} else {
+		call = &queryCall{done: make(chan struct{})}
+		qc.calls[key] = call
+		qc.misses++
+		go qc.fetch(key, call, fetch)
+	}
+	qc.lock.Unlock()
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("query [%v] to %v is cancelled: %w", key.query, key.server, ctx.Err())
+	}
+	if found {
+		glog.V(4).Infof("Reused the result of query [%v] to %v.", key.query, key.server)
+	}
+	return call.result, call.err
+}
+
+// fetch sends the query of the call within the context of the discovery cycle. The call is removed from the
+// cache if the query is cancelled or times out.
+func (qc *QueryCache) fetch(key queryKey, call *queryCall,
+	fetch func(ctx context.Context) ([]MetricData, error)) {
+	defer close(call.done)
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Query [%v] to %v panicked: %v\n%s", key.query, key.server, r, debug.Stack())
+			call.result, call.err = nil, fmt.Errorf("query [%v] to %v panicked: %v", key.query, key.server, r)
+		}
+	}()
+	call.result, call.err = fetch(qc.ctx)
+	if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+		qc.lock.Lock()
+		if qc.calls[key] == call {
+			delete(qc.calls, key)
+		}
+		qc.lock.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCacheDeduplicatesQueries(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"]}}`))
+	}))
+	defer server.Close()
+	client1, err := NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	client2, err := NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+
+	queryCache := NewQueryCache(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		client := client1
+		if i%2 == 1 {
+			client = client2
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := queryCache.GetMetrics(context.Background(), client, "up")
+			assert.Nil(t, err)
+			assert.Equal(t, []MetricData{&ScalarMetricData{Value: 1}}, result)
+		}()
+	}
+	// Let the concurrent callers reach the cache before the first query completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	_, err = queryCache.GetMetrics(context.Background(), client1, "up")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Different queries are not shared
+	_, err = queryCache.GetMetrics(context.Background(), client1, "down")
+	assert.Nil(t, err)
+	_, err = queryCache.GetRangeMetrics(context.Background(), client1, "up", time.Minute, time.Second)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+	hits, misses := queryCache.Stats()
+	assert.Equal(t, 10, hits)
+	assert.Equal(t, 3, misses)
+}
+
+func TestQueryCacheWithDifferentDeadlines(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"]}}`))
+	}))
+	defer server.Close()
+	client := newTestRestClient(t, server.URL)
+	queryCache := NewQueryCache(context.Background())
+
+	// The first caller gives up before the result, the second one still gets it from the same query
+	shortCtx, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShort()
+	longCtx, cancelLong := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelLong()
+	second := make(chan error)
+	_, err := queryCache.GetMetrics(shortCtx, client, "up")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	go func() {
+		result, err := queryCache.GetMetrics(longCtx, client, "up")
+		assert.Equal(t, []MetricData{&ScalarMetricData{Value: 1}}, result)
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	assert.Nil(t, <-second)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestQueryCacheDoesNotCacheCancelledQueries(t *testing.T) {
+	var requests atomic.Int32
+	server := newStatusServer(&requests)
+	defer server.Close()
+	client := newTestRestClient(t, server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queryCache := NewQueryCache(ctx)
+	_, err := queryCache.GetMetrics(context.Background(), client, "up")
+	assert.ErrorIs(t, err, context.Canceled)
+	// The cancelled query is not cached, and is sent again by the next caller
+	queryCache.ctx = context.Background()
+	_, err = queryCache.GetMetrics(context.Background(), client, "up")
+	assert.Nil(t, err)
+	hits, misses := queryCache.Stats()
+	assert.Equal(t, 0, hits)
+	assert.Equal(t, 2, misses)
+}
+
+func TestNilQueryCache(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+	client, err := NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	var queryCache *QueryCache
+	for i := 0; i < 2; i++ {
+		_, err := queryCache.GetMetrics(context.Background(), client, "up")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(2), requests.Load())
+}
@@ -1,27 +1,38 @@
 package prometheus
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
 	"github.ibm.com/turbonomic/prometurbo/pkg/util"
 )
 
 const (
 	apiPath      = "/api/v1/"
 	apiQueryPath = "/api/v1/query"
+	// Suffix appended to the instant query path to get the range query path
+	rangeQuerySuffix = "_range"
+	// Maximum number of points per series that Prometheus returns for a range query
+	maxRangeQueryPoints = 11000
 
 	defaultTimeOut             = 60 * time.Second
 	defaultPrometheusTokenFile = "/etc/prometheus-tokens"
@@ -40,32 +51,49 @@ type RawData struct {
 	Result     json.RawMessage `json:"result"`
 }
 
-type RestClient struct {
-	client      *http.Client
-	host        string
-	username    string
-	password    string
-	bearerToken string
+// errAPI is returned when the Prometheus server responds with an error status in the response body
+var errAPI = errors.New("prometheus API returned an error")
+
+// HTTPError is returned when the Prometheus server responds with a status code of 400 or above
+type HTTPError struct {
+	StatusCode int
+	Body       string
 }
 
-var prometheusTokenFolder string
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("prometheus API request failed with status %d: error response: %s", e.StatusCode, e.Body)
+}
 
-var (
-	//Shared HTTP transport with proper connection pooling and limits.
-	apiHTTPTransport = &http.Transport{
-		MaxIdleConns:        10,
-		MaxIdleConnsPerHost: 5,
-		DisableKeepAlives:   false,
-		IdleConnTimeout:     defaultTimeOut,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+// IsAuthError returns true if the error is caused by a rejected authentication or authorization
+func IsAuthError(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden
 	}
+	return false
+}
 
-	// Shared HTTP client using the defined transport.
-	apiHTTPClient = &http.Client{
-		Transport: apiHTTPTransport,
-		Timeout:   defaultTimeOut,
-	}
-)
+type RestClient struct {
+	client   *http.Client
+	host     string
+	username string
+	password string
+	// Source of the bearer token; no token if nil
+	token   TokenSource
+	retry   retryPolicy
+	breaker *circuitBreaker
+	limiter *queryLimiter
+	// TLS configuration of the connections, also used by the token source to obtain the tokens
+	tlsConfig *tls.Config
+	// Fingerprint of the client certificate, which identifies the client to servers requiring mutual TLS
+	tlsIdentity string
+	// Additional headers of the requests, e.g. the tenant header of a multi-tenant backend
+	headers map[string]string
+	// Signer of the requests to Amazon Managed Service for Prometheus; the requests are not signed if nil
+	signer *SigV4Signer
+}
+
+var prometheusTokenFolder string
 
 func init() {
 	flag.StringVar(&prometheusTokenFolder, "prometheusTokenFolder", defaultPrometheusTokenFile,
@@ -73,11 +101,23 @@ func init() {
 }
 
 // NewRestClient
-// The method uses a shared prometheus HTTP API client.
+// The client has its own transport, which verifies the server certificate against the system CAs unless
+// configured otherwise with WithTLSConfig.
 // Authorization token (bearerToken) for Prometheus server. Might be an empty string.
 // In case of CR deployment the token goes from a Secret defined in 'PrometheusServerConfig' resource.
 // In case of Configmap deployment the token goes from the file `prometheus.config` defined in a Configmap for the probe.
 func NewRestClient(host string, bearerToken string) (*RestClient, error) {
+	var token TokenSource
+	if len(bearerToken) > 0 {
+		token = staticToken(bearerToken)
+	}
+	return NewRestClientWithTokenSource(host, token)
+}
+
+// NewRestClientWithTokenSource creates a client reading its bearer token from the token source, which can be
+// nil if the server does not require a token. As with NewRestClient, a token file of the server has a higher
+// priority.
+func NewRestClientWithTokenSource(host string, token TokenSource) (*RestClient, error) {
 
 	//1. check whether it is using ssl
 	if !strings.HasPrefix(host, "http") {
@@ -98,15 +138,152 @@ func NewRestClient(host string, bearerToken string) (*RestClient, error) {
 	}
 
 	// If Prometheus token was provided in a mounted file, it has higher priority and we use it.
-	if tokenFromFile := getBearerTokenFormFile(addr.Hostname()); len(tokenFromFile) > 0 {
-		bearerToken = tokenFromFile
+	// The file is read again when the token is rotated. An OAuth2 client is explicitly configured, so it is
+	// kept rather than silently replaced by the file.
+	if tokenFile := filepath.Join(prometheusTokenFolder, addr.Hostname()); util.FileExists(tokenFile) {
+		if _, isOAuth2 := token.(*oauth2Token); isOAuth2 {
+			glog.Warningf("Ignored auth token file '%v' of %v, which is configured with OAuth2.", tokenFile, host)
+		} else {
+			if token != nil {
+				glog.Warningf("Auth token file '%v' overrides the configured token of %v.", tokenFile, host)
+			}
+			glog.V(1).Infof("Use auth token from file '%v'", tokenFile)
+			token = NewFileTokenSource(tokenFile)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	c := &RestClient{
+		client: &http.Client{
+			Transport: newTransport(tlsConfig),
+			Timeout:   defaultTimeOut,
+		},
+		host:      host,
+		token:     token,
+		tlsConfig: tlsConfig,
+		retry: retryPolicy{
+			maxRetries:     defaultMaxRetries,
+			initialBackoff: defaultInitialBackoff,
+			maxBackoff:     defaultMaxBackoff,
+		},
+		breaker: newCircuitBreaker(DefaultFailureThreshold, defaultCooldown),
+	}
+	c.setTokenTLSConfig()
+	return c, nil
+}
+
+// WithTimeout sets the timeout of each attempt of a query
+func (c *RestClient) WithTimeout(timeout time.Duration) *RestClient {
+	if timeout > 0 {
+		c.client = &http.Client{
+			Transport: c.client.Transport,
+			Timeout:   timeout,
+		}
+	}
+	return c
+}
+
+// WithTLSConfig sets the TLS configuration of the connections to the server
+func (c *RestClient) WithTLSConfig(tlsConfig *tls.Config) *RestClient {
+	c.client = &http.Client{
+		Transport: newTransport(tlsConfig),
+		Timeout:   c.client.Timeout,
+	}
+	c.tlsConfig = tlsConfig
+	c.tlsIdentity = ""
+	if len(tlsConfig.Certificates) > 0 && len(tlsConfig.Certificates[0].Certificate) > 0 {
+		c.tlsIdentity = fmt.Sprintf("%x", sha256.Sum256(tlsConfig.Certificates[0].Certificate[0]))
+	}
+	c.setTokenTLSConfig()
+	return c
+}
+
+// WithTokenSource sets the source of the bearer token, which is read again when the server rejects the token
+func (c *RestClient) WithTokenSource(token TokenSource) *RestClient {
+	c.token = token
+	c.setTokenTLSConfig()
+	return c
+}
+
+// tlsConfigurable is a TokenSource sending its own requests, e.g. to an OAuth2 token endpoint
+type tlsConfigurable interface {
+	setTLSConfig(tlsConfig *tls.Config)
+}
+
+// setTokenTLSConfig makes the token source use the TLS configuration of the client, if it sends requests
+func (c *RestClient) setTokenTLSConfig() {
+	if token, ok := c.token.(tlsConfigurable); ok {
+		token.setTLSConfig(c.tlsConfig)
+	}
+}
+
+// WithSigV4Signer signs the requests with AWS Signature Version 4, instead of authenticating with a bearer token
+// or a basic authentication
+func (c *RestClient) WithSigV4Signer(signer *SigV4Signer) *RestClient {
+	c.signer = signer
+	return c
+}
+
+// WithHeaders adds the headers to the requests sent to the server, e.g. X-Scope-OrgID for the tenant of a
+// Cortex, Mimir or Thanos backend. The headers replace the ones previously set on the client.
+func (c *RestClient) WithHeaders(headers map[string]string) *RestClient {
+	c.headers = mergeHeaders(nil, headers)
+	return c
+}
+
+// ForTenant returns a client sending the queries with the headers of a tenant in addition to the headers of
+// this client. The tenant client shares the connections, the retry policy, the circuit breaker and the query
+// limits with this client, so that the limits apply to the server as a whole.
+func (c *RestClient) ForTenant(headers map[string]string) *RestClient {
+	tenant := *c
+	tenant.headers = mergeHeaders(c.headers, headers)
+	return &tenant
+}
+
+// mergeHeaders returns the headers overridden by the other headers, by their canonical names
+func mergeHeaders(headers, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(headers)+len(overrides))
+	for name, value := range headers {
+		merged[name] = value
+	}
+	for name, value := range overrides {
+		merged[http.CanonicalHeaderKey(name)] = value
+	}
+	return merged
+}
+
+// WithRetry sets the number of times a query is retried after failing with a connection error, a timeout,
+// a 5xx or a 429 status
+func (c *RestClient) WithRetry(maxRetries int) *RestClient {
+	if maxRetries >= 0 {
+		c.retry.maxRetries = maxRetries
+	}
+	return c
+}
+
+// WithCircuitBreaker stops sending queries for the cooldown period after the given number of consecutive
+// failed attempts. The circuit breaker is disabled if failureThreshold is 0, and the default cooldown period
+// is used if cooldown is 0.
+func (c *RestClient) WithCircuitBreaker(failureThreshold int, cooldown time.Duration) *RestClient {
+	if cooldown <= 0 {
+		cooldown = defaultCooldown
 	}
+	c.breaker = newCircuitBreaker(failureThreshold, cooldown)
+	return c
+}
+
+// WithRateLimit limits the number of concurrent queries and the number of queries per second sent to the
+// server, 0 for no limit. Retries are limited as well. The limits are shared by all the clients of the same
+// server address with the same limits, across the configuration objects and the reloads of the configuration.
+func (c *RestClient) WithRateLimit(maxConcurrentQueries int, queriesPerSecond float64) *RestClient {
+	c.limiter = sharedQueryLimiter(c.host, maxConcurrentQueries, queriesPerSecond)
+	return c
+}
 
-	return &RestClient{
-		client:      apiHTTPClient,
-		host:        host,
-		bearerToken: bearerToken,
-	}, nil
+// Saturated tells whether the maximum number of concurrent queries to the server are in flight, so that a new
+// query would wait for one of them to complete
+func (c *RestClient) Saturated() bool {
+	return c.limiter.saturated()
 }
 
 // GetHost get the host associated with the prometheus client
@@ -121,36 +298,194 @@ func (c *RestClient) SetUser(username, password string) {
 }
 
 // Query query the prometheus server, and return the rawData
-func (c *RestClient) Query(query string) (*RawData, error) {
+func (c *RestClient) Query(ctx context.Context, query string) (*RawData, error) {
 	query = strings.TrimSpace(query)
 	if len(query) < 1 {
 		err := fmt.Errorf("prometheus query is empty")
 		glog.Errorf(err.Error())
 		return nil, err
 	}
+	// Always appending the current unix timestamp as some server implementation such as the one in IBM Cloud
+	// doesn't conform to the Prometheus specs and treat the time parameter as optional.
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatInt(time.Now().Unix(), 10))
+	return c.doQuery(ctx, c.host, params)
+}
 
-	req, err := http.NewRequest("GET", c.host, nil)
+// QueryRange query the prometheus server over the time range [now-window, now] with the given resolution step,
+// and return the rawData
+func (c *RestClient) QueryRange(ctx context.Context, query string, window, step time.Duration) (*RawData, error) {
+	query = strings.TrimSpace(query)
+	if len(query) < 1 {
+		err := fmt.Errorf("prometheus query is empty")
+		glog.Errorf(err.Error())
+		return nil, err
+	}
+	if err := ValidateRange(window, step); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(c.host, "/query") {
+		return nil, fmt.Errorf("range query is not supported by query endpoint %v", c.host)
+	}
+	end := time.Now()
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(end.Add(-window).Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+	return c.doQuery(ctx, c.host+rangeQuerySuffix, params)
+}
+
+// ValidateRange validates the time range and the resolution step of a range query
+func ValidateRange(window, step time.Duration) error {
+	if window <= 0 || step <= 0 {
+		return fmt.Errorf("range window %v and step %v must be positive", window, step)
+	}
+	if step > window {
+		return fmt.Errorf("range step %v is larger than window %v", step, window)
+	}
+	if int64(window/step) > maxRangeQueryPoints {
+		return fmt.Errorf("range window %v with step %v exceeds the maximum of %d points per series",
+			window, step, maxRangeQueryPoints)
+	}
+	return nil
+}
+
+// doQuery sends the query, retrying it according to the retry policy unless the circuit breaker is open.
+// The query and the retries are abandoned when the context is done.
+// A query rejected with a 401 or a 403 status is sent again once if the token has been rotated.
+func (c *RestClient) doQuery(ctx context.Context, endpoint string, params url.Values) (*RawData, error) {
+	refreshed := false
+	for retry := 0; ; retry++ {
+		trial, err := c.breaker.allow()
+		if err != nil {
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonCircuitOpen).Inc()
+			return nil, err
+		}
+		// A trial query whose outcome is not recorded is aborted, otherwise the breaker would stay half-open
+		abortTrial := func() {
+			if trial {
+				c.breaker.abortTrial()
+			}
+		}
+		release, err := c.limiter.acquire(ctx)
+		if err != nil {
+			abortTrial()
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonCancelled).Inc()
+			return nil, fmt.Errorf("query to %v is not sent within the limits: %w", c.host, err)
+		}
+		token, err := c.getToken(ctx)
+		if err != nil {
+			release()
+			abortTrial()
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonConnection).Inc()
+			return nil, err
+		}
+		start := time.Now()
+		data, err := c.doQueryOnce(ctx, endpoint, params, token)
+		selfmetrics.QueryDuration.WithLabelValues(c.host, path.Base(endpoint)).Observe(time.Since(start).Seconds())
+		release()
+		if ctx.Err() != nil {
+			// The failure is caused by the cancellation of the discovery rather than by the server
+			abortTrial()
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonCancelled).Inc()
+			return nil, fmt.Errorf("query to %v is cancelled: %w", c.host, ctx.Err())
+		}
+		if IsAuthError(err) && !refreshed && c.refreshToken(ctx, token) {
+			// The rejected token has been rotated, which does not count as a retry
+			glog.V(2).Infof("Sending query to %v again with the rotated token after failure: %v", c.host, err)
+			refreshed = true
+			retry--
+			abortTrial()
+			continue
+		}
+		c.breaker.record(err, c.host)
+		if err == nil || retry >= c.retry.maxRetries || !isRetryable(err) {
+			if err != nil {
+				selfmetrics.QueryErrors.WithLabelValues(c.host, errorReason(err)).Inc()
+			}
+			return data, err
+		}
+		backoff := c.retry.backoff(retry + 1)
+		glog.V(2).Infof("Retrying query to %v in %v after failure: %v", c.host, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonCancelled).Inc()
+			return nil, fmt.Errorf("query to %v is cancelled: %w", c.host, ctx.Err())
+		}
+	}
+}
+
+// errorReason classifies the error of a query for the query error metric
+func errorReason(err error) string {
+	var httpErr *HTTPError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &httpErr):
+		return selfmetrics.ReasonHTTP
+	case errors.Is(err, errAPI):
+		return selfmetrics.ReasonAPI
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return selfmetrics.ReasonDecode
+	default:
+		return selfmetrics.ReasonConnection
+	}
+}
+
+// getToken returns the current bearer token, or an empty string if the client has no token
+func (c *RestClient) getToken(ctx context.Context) (string, error) {
+	if c.token == nil {
+		return "", nil
+	}
+	token, err := c.token.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the bearer token of %v: %v", c.host, err)
+	}
+	return token, nil
+}
+
+// refreshToken reads the token again after it has been rejected, and returns true if it has been rotated
+func (c *RestClient) refreshToken(ctx context.Context, rejected string) bool {
+	if c.token == nil || len(c.username) > 0 {
+		return false
+	}
+	rotated, err := c.token.Refresh(ctx, rejected)
+	if err != nil {
+		glog.Errorf("Failed to refresh the bearer token of %v: %v", c.host, err)
+		return false
+	}
+	return rotated
+}
+
+func (c *RestClient) doQueryOnce(ctx context.Context, endpoint string, params url.Values,
+	token string) (*RawData, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		glog.Errorf("Failed to generate a http.request: %v", err)
 		return nil, err
 	}
 
 	// 1. set query
-	// Always appending the current unix timestamp as some server implementation such as the one in IBM Cloud
-	// doesn't conform to the Prometheus specs and treat the time parameter as optional.
 	q := req.URL.Query()
-	q.Set("query", query)
-	q.Set("time", strconv.FormatInt(time.Now().Unix(), 10))
+	for k, v := range params {
+		q[k] = v
+	}
 	req.URL.RawQuery = q.Encode()
 
 	//2. set headers
-	addHttpHeaders(*req, *c)
+	addHttpHeaders(*req, *c, token)
+	if err := c.sign(req); err != nil {
+		return nil, err
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		glog.Errorf("Failed to send http request: %v", err)
 		// Close idle connections on failure
-		apiHTTPTransport.CloseIdleConnections()
+		c.client.CloseIdleConnections()
 		glog.V(3).Info("Closed idle connections due to request failure.")
 		return nil, err
 	}
@@ -166,8 +501,7 @@ func (c *RestClient) Query(query string) (*RawData, error) {
 	// Invalid requests that reach the Prometheus server API handlers return a JSON error object with
 	// a >400 status code instead of an error in the response.
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("prometheus API request failed with status %d: error response: %s",
-			resp.StatusCode, string(result))
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Body: string(result)}
 	}
 	var ss Response
 	if err := json.Unmarshal(result, &ss); err != nil {
@@ -176,37 +510,38 @@ func (c *RestClient) Query(query string) (*RawData, error) {
 	}
 
 	if ss.Status == "error" {
-		return nil, fmt.Errorf("prometheus API returned an error: %s", ss.Error)
+		return nil, fmt.Errorf("%w: %s", errAPI, ss.Error)
 	}
 	return ss.Data, nil
 }
 
 // GetMetrics send a query to prometheus server, and return a list of MetricData
 //
-//	Note: it only support 'vector query: the data in the response is a 'vector'
-//	       not a 'matrix' (range query), 'string', or 'scalar'
 //	(1) the Request will generate a query;
-//	(2) the Request will parse the response into a list of MetricData
-func (c *RestClient) GetMetrics(request string) ([]MetricData, error) {
+//	(2) the Request will parse the response into a list of MetricData according to the result type:
+//	    - 'vector': a BasicMetricData for each series
+//	    - 'matrix': a RangeMetricData for each series, e.g. for a query with a range vector selector
+//	    - 'scalar' or 'string': a single ScalarMetricData; a string must hold a number
+func (c *RestClient) GetMetrics(ctx context.Context, request string) ([]MetricData, error) {
 	var result []MetricData
 
 	//1. query
-	response, err := c.Query(request)
+	response, err := c.Query(ctx, request)
 	if err != nil {
 		glog.Errorf("Failed to get metrics from prometheus; url: %v, query: %v, error: %v", c.host, request, err)
 		return result, err
 	}
-
-	if response == nil || response.ResultType != "vector" {
-		err := fmt.Errorf("unsupported result type: %v", response.ResultType)
+	if response == nil {
+		err := fmt.Errorf("empty response data")
 		glog.Errorf(err.Error())
 		return result, err
 	}
 
 	//2. parse/decode the value
-	var rawMetrics []RawMetric
-	if err := json.Unmarshal(response.Result, &rawMetrics); err != nil {
+	rawMetrics, err := decodeResult(response)
+	if err != nil {
 		glog.Errorf("Failed to unmarshal: %v", err)
+		selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonDecode).Inc()
 		return result, err
 	}
 
@@ -215,15 +550,156 @@ func (c *RestClient) GetMetrics(request string) ([]MetricData, error) {
 		d, err := rawMetrics[i].Parse()
 		if err != nil {
 			glog.Errorf("Failed to parse value: %v", err)
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonDecode).Inc()
 			continue
 		}
 		glog.V(4).Infof("Successfully parsed metric data: %v", spew.Sdump(d))
 		result = append(result, d)
 	}
+	selfmetrics.QuerySeries.WithLabelValues(c.host).Add(float64(len(result)))
 
 	return result, nil
 }
 
+// rawResult is implemented by the raw result of each Prometheus result type
+type rawResult interface {
+	Parse() (MetricData, error)
+}
+
+// decodeResult decodes the result in the response data according to its result type
+func decodeResult(response *RawData) ([]rawResult, error) {
+	var rawResults []rawResult
+	switch response.ResultType {
+	case "vector":
+		var rawMetrics []RawMetric
+		if err := json.Unmarshal(response.Result, &rawMetrics); err != nil {
+			return nil, err
+		}
+		for _, rawMetric := range rawMetrics {
+			rawResults = append(rawResults, rawMetric)
+		}
+	case "matrix":
+		var rawMetrics []RawRangeMetric
+		if err := json.Unmarshal(response.Result, &rawMetrics); err != nil {
+			return nil, err
+		}
+		for _, rawMetric := range rawMetrics {
+			rawResults = append(rawResults, rawMetric)
+		}
+	case "scalar":
+		var rawScalar model.Scalar
+		if err := json.Unmarshal(response.Result, &rawScalar); err != nil {
+			return nil, err
+		}
+		rawResults = append(rawResults, RawScalar(rawScalar))
+	case "string":
+		var rawString model.String
+		if err := json.Unmarshal(response.Result, &rawString); err != nil {
+			return nil, err
+		}
+		rawResults = append(rawResults, RawString(rawString))
+	default:
+		return nil, fmt.Errorf("unsupported result type: %v", response.ResultType)
+	}
+	return rawResults, nil
+}
+
+// GetRangeMetrics send a range query over the last window to prometheus server, and return a list of
+// RangeMetricData, one for each series in the 'matrix' result
+func (c *RestClient) GetRangeMetrics(ctx context.Context, request string, window, step time.Duration) ([]MetricData, error) {
+	var result []MetricData
+
+	//1. query
+	response, err := c.QueryRange(ctx, request, window, step)
+	if err != nil {
+		glog.Errorf("Failed to get range metrics from prometheus; url: %v, query: %v, error: %v", c.host, request, err)
+		return result, err
+	}
+
+	if response == nil {
+		err := fmt.Errorf("empty response data")
+		glog.Errorf(err.Error())
+		selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonDecode).Inc()
+		return result, err
+	}
+	if response.ResultType != "matrix" {
+		err := fmt.Errorf("unsupported result type for range query: %v", response.ResultType)
+		glog.Errorf(err.Error())
+		selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonDecode).Inc()
+		return result, err
+	}
+
+	//2. parse/decode the values
+	var rawMetrics []RawRangeMetric
+	if err := json.Unmarshal(response.Result, &rawMetrics); err != nil {
+		glog.Errorf("Failed to unmarshal: %v", err)
+		selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonDecode).Inc()
+		return result, err
+	}
+
+	//3. assign the values
+	for i := range rawMetrics {
+		d, err := rawMetrics[i].Parse()
+		if err != nil {
+			glog.Errorf("Failed to parse values: %v", err)
+			selfmetrics.QueryErrors.WithLabelValues(c.host, selfmetrics.ReasonDecode).Inc()
+			continue
+		}
+		glog.V(4).Infof("Successfully parsed range metric data: %v", spew.Sdump(d))
+		result = append(result, d)
+	}
+	selfmetrics.QuerySeries.WithLabelValues(c.host).Add(float64(len(result)))
+
+	return result, nil
+}
+
+// serverKey identifies the server that the client sends queries to, and the identity it authenticates as,
+// so that the results of identical queries can be shared by the clients with the same key
+func (c *RestClient) serverKey() string {
+	key := c.host + "|" + c.username + "|" + c.credentialsFingerprint() + "|" + c.tlsIdentity + "|" +
+		c.headersFingerprint()
+	if c.signer != nil {
+		key += "|" + c.signer.identity
+	}
+	return key
+}
+
+// sign signs the request if the client has a SigV4 signer
+func (c *RestClient) sign(req *http.Request) error {
+	if c.signer == nil {
+		return nil
+	}
+	if err := c.signer.sign(req); err != nil {
+		return fmt.Errorf("failed to sign the request to %v: %v", c.host, err)
+	}
+	return nil
+}
+
+// credentialsFingerprint identifies the password and the source of the bearer token without revealing them
+func (c *RestClient) credentialsFingerprint() string {
+	if c.password == "" && c.token == nil {
+		return ""
+	}
+	return hashHex(c.password + "\x00" + tokenIdentity(c.token))
+}
+
+// headersFingerprint identifies the additional headers without revealing their values, which can be secrets
+func (c *RestClient) headersFingerprint() string {
+	if len(c.headers) == 0 {
+		return ""
+	}
+	headers := make([]string, 0, len(c.headers))
+	for name, value := range c.headers {
+		headers = append(headers, name+"\x00"+value)
+	}
+	sort.Strings(headers)
+	hash := sha256.New()
+	for _, header := range headers {
+		fmt.Fprintf(hash, "%s\x00", header)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
 func (c *RestClient) Validate() (string, error) {
 	jobs, err := c.getJobs()
 	if err != nil {
@@ -242,7 +718,14 @@ func (c *RestClient) getJobs() (string, error) {
 		glog.Errorf("Failed to generate a http.request: %v", err)
 		return "", err
 	}
-	addHttpHeaders(*req, *c)
+	token, err := c.getToken(context.Background())
+	if err != nil {
+		return "", err
+	}
+	addHttpHeaders(*req, *c, token)
+	if err := c.sign(req); err != nil {
+		return "", err
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -260,27 +743,14 @@ func (c *RestClient) getJobs() (string, error) {
 	return string(result), nil
 }
 
-func addHttpHeaders(req http.Request, client RestClient) {
+func addHttpHeaders(req http.Request, client RestClient, bearerToken string) {
 	req.Header.Set("Accept", "application/json")
+	for name, value := range client.headers {
+		req.Header.Set(name, value)
+	}
 	if len(client.username) > 0 {
 		req.SetBasicAuth(client.username, client.password)
-	} else if len(client.bearerToken) > 0 {
-		req.Header.Add("Authorization", "Bearer "+client.bearerToken)
-	}
-}
-
-// The method reads prometheus server auth token from file {token-dir}/{server-hostname}.
-func getBearerTokenFormFile(hostname string) string {
-	tokenFile := filepath.Join(prometheusTokenFolder, hostname)
-	if !util.FileExists(tokenFile) {
-		return ""
-	}
-	tokenBytes, err := os.ReadFile(tokenFile)
-	if err != nil {
-		glog.Errorf("Failed to read token file %v", err)
-		return ""
+	} else if len(bearerToken) > 0 {
+		req.Header.Add("Authorization", "Bearer "+bearerToken)
 	}
-	token := string(tokenBytes)
-	glog.V(1).Infof("Use auth token (len=%d) from file '%v'", len(token), tokenFile)
-	return token
 }
@@ -1,8 +1,18 @@
 package prometheus
 
 import (
-	"github.com/stretchr/testify/assert"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
 )
 
 func TestNewClient(t *testing.T) {
@@ -26,6 +36,165 @@ func TestNewClient(t *testing.T) {
 			t.Errorf("Failed to create rest client: %v", err)
 		}
 		assert.Equal(t, host.expectedOutput, client.host)
-		assert.Equal(t, client.bearerToken, testToken)
+		token, err := client.getToken(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, token, testToken)
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	assert.Nil(t, ValidateRange(10*time.Minute, 30*time.Second))
+	assert.NotNil(t, ValidateRange(0, 30*time.Second))
+	assert.NotNil(t, ValidateRange(time.Minute, 0))
+	assert.NotNil(t, ValidateRange(time.Minute, 2*time.Minute))
+	assert.NotNil(t, ValidateRange(24*time.Hour, time.Second))
+}
+
+func TestQueryRangeWithCustomPath(t *testing.T) {
+	client, err := NewRestClient("https://x.y.z/api/v2/promql/eval", "")
+	assert.Nil(t, err)
+	_, err = client.QueryRange(context.Background(), "up", 10*time.Minute, time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestGetRangeMetricsWithoutData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+	client, err := NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	_, err = client.GetRangeMetrics(context.Background(), "up", 10*time.Minute, time.Minute)
+	assert.ErrorContains(t, err, "empty response data")
+}
+
+func TestDecodeResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     RawData
+		expected []MetricData
+		wantErr  bool
+	}{
+		{
+			name: "vector",
+			data: RawData{ResultType: "vector", Result: []byte(`[{"metric":{"job":"a"},"value":[1700000000,"1.5"]}]`)},
+			expected: []MetricData{
+				&BasicMetricData{Labels: map[string]string{"job": "a"}, Value: 1.5, Timestamp: time.Unix(1700000000, 0)},
+			},
+		},
+		{
+			name: "matrix",
+			data: RawData{ResultType: "matrix", Result: []byte(`[{"metric":{"job":"a"},"values":[[1700000000,"1"],[1700000060,"2"]]}]`)},
+			expected: []MetricData{
+				&RangeMetricData{Labels: map[string]string{"job": "a"}, Values: []float64{1, 2},
+					Timestamp: time.Unix(1700000060, 0)},
+			},
+		},
+		{
+			name:     "scalar",
+			data:     RawData{ResultType: "scalar", Result: []byte(`[1700000000,"42"]`)},
+			expected: []MetricData{&ScalarMetricData{Value: 42}},
+		},
+		{
+			name:     "string",
+			data:     RawData{ResultType: "string", Result: []byte(`[1700000000," 8 "]`)},
+			expected: []MetricData{&ScalarMetricData{Value: 8}},
+		},
+		{
+			name:     "non-numeric string",
+			data:     RawData{ResultType: "string", Result: []byte(`[1700000000,"abc"]`)},
+			expected: nil,
+		},
+		{
+			name:    "unknown",
+			data:    RawData{ResultType: "histogram", Result: []byte(`[]`)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rawResults, err := decodeResult(&tt.data)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			var metrics []MetricData
+			for _, rawResult := range rawResults {
+				if d, err := rawResult.Parse(); err == nil {
+					metrics = append(metrics, d)
+				}
+			}
+			assert.Equal(t, tt.expected, metrics)
+		})
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	assert.Equal(t, selfmetrics.ReasonHTTP, errorReason(&HTTPError{StatusCode: http.StatusBadRequest}))
+	assert.Equal(t, selfmetrics.ReasonAPI, errorReason(fmt.Errorf("%w: bad query", errAPI)))
+	assert.Equal(t, selfmetrics.ReasonDecode, errorReason(json.Unmarshal([]byte("{"), &Response{})))
+	assert.Equal(t, selfmetrics.ReasonConnection, errorReason(errors.New("connection refused")))
+}
+
+func TestTenantHeaders(t *testing.T) {
+	requests := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Header.Clone()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithRetry(0).WithHeaders(map[string]string{
+		"X-Scope-OrgID": "shared",
+		"X-Api-Key":     "secret",
+	})
+	tenant := client.ForTenant(map[string]string{"x-scope-orgid": "team-a"})
+
+	_, _ = client.Query(context.Background(), "up")
+	header := <-requests
+	assert.Equal(t, "shared", header.Get("X-Scope-OrgID"))
+	assert.Equal(t, "secret", header.Get("X-Api-Key"))
+	_, _ = tenant.Query(context.Background(), "up")
+	header = <-requests
+	assert.Equal(t, "team-a", header.Get("X-Scope-OrgID"))
+	assert.Equal(t, "secret", header.Get("X-Api-Key"))
+
+	// The results of the tenants are never shared, and the values of the headers are not revealed
+	assert.NotEqual(t, client.serverKey(), tenant.serverKey())
+	assert.Equal(t, tenant.serverKey(), client.ForTenant(map[string]string{"X-Scope-OrgID": "team-a"}).serverKey())
+	assert.NotContains(t, client.serverKey(), "secret")
+}
+
+func TestServerKeyWithCredentials(t *testing.T) {
+	newClient := func(token string) *RestClient {
+		client, err := NewRestClient("http://127.0.0.1:9090", token)
+		assert.Nil(t, err)
+		return client
+	}
+	// The results of the clients with different credentials are never shared, and the credentials are not revealed
+	assert.NotEqual(t, newClient("token-a").serverKey(), newClient("token-b").serverKey())
+	assert.NotEqual(t, newClient("").serverKey(), newClient("token-a").serverKey())
+	assert.Equal(t, newClient("token-a").serverKey(), newClient("token-a").serverKey())
+	assert.NotContains(t, newClient("token-a").serverKey(), "token-a")
+
+	withPassword := func(password string) string {
+		client := newClient("")
+		client.SetUser("user", password)
+		return client.serverKey()
+	}
+	assert.NotEqual(t, withPassword("password-a"), withPassword("password-b"))
+	assert.NotContains(t, withPassword("password-a"), "password-a")
+
+	// The sources of rotated tokens are identified by where the token is read from
+	fileA := newClient("").WithTokenSource(NewFileTokenSource("/tokens/a"))
+	fileB := newClient("").WithTokenSource(NewFileTokenSource("/tokens/b"))
+	assert.NotEqual(t, fileA.serverKey(), fileB.serverKey())
+	assert.Equal(t, fileA.serverKey(), newClient("").WithTokenSource(NewFileTokenSource("/tokens/a")).serverKey())
+	oauth2 := func(clientID string) string {
+		token, err := NewOAuth2TokenSource(OAuth2Config{TokenURL: "https://idp/token", ClientID: clientID})
+		assert.Nil(t, err)
+		return newClient("").WithTokenSource(token).serverKey()
 	}
+	assert.NotEqual(t, oauth2("client-a"), oauth2("client-b"))
+	assert.Equal(t, oauth2("client-a"), oauth2("client-a"))
 }
@@ -0,0 +1,130 @@
+package prometheus
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// A shared limiter that has not been used for this duration is evicted, as its clients have been replaced
+	// by the reloads of the configuration or their servers have been removed
+	limiterIdleTimeout = time.Hour
+)
+
+// limiterKey identifies the limits of a server
+type limiterKey struct {
+	host                 string
+	maxConcurrentQueries int
+	queriesPerSecond     float64
+}
+
+var (
+	// sharedLimiters are the limiters of the servers by their limits, shared by all the clients of a server with
+	// the same limits, as the clients are created again for every configuration object and every reload.
+	// The idle limiters are evicted when a limiter is looked up.
+	sharedLimiters     = map[limiterKey]*queryLimiter{}
+	sharedLimitersLock sync.Mutex
+)
+
+// queryLimiter limits the number of concurrent queries and the rate of the queries to a server. A nil
+// queryLimiter does not limit the queries.
+type queryLimiter struct {
+	// A slot is taken for each query in flight; no limit if nil
+	slots chan struct{}
+	// No limit if nil
+	rate *rate.Limiter
+	// Unix time in nanoseconds of the last acquisition or release of the limiter
+	lastUsed atomic.Int64
+}
+
+func newQueryLimiter(maxConcurrentQueries int, queriesPerSecond float64) *queryLimiter {
+	if maxConcurrentQueries <= 0 && queriesPerSecond <= 0 {
+		return nil
+	}
+	limiter := &queryLimiter{}
+	if maxConcurrentQueries > 0 {
+		limiter.slots = make(chan struct{}, maxConcurrentQueries)
+	}
+	if queriesPerSecond > 0 {
+		limiter.rate = rate.NewLimiter(rate.Limit(queriesPerSecond), 1)
+	}
+	limiter.touch()
+	return limiter
+}
+
+// sharedQueryLimiter returns the limiter shared by the clients of the server with the same limits
+func sharedQueryLimiter(host string, maxConcurrentQueries int, queriesPerSecond float64) *queryLimiter {
+	if maxConcurrentQueries <= 0 && queriesPerSecond <= 0 {
+		return nil
+	}
+	key := limiterKey{host: host, maxConcurrentQueries: maxConcurrentQueries, queriesPerSecond: queriesPerSecond}
+	sharedLimitersLock.Lock()
+	defer sharedLimitersLock.Unlock()
+	evictIdleLimiters(time.Now())
+	limiter, found := sharedLimiters[key]
+	if !found {
+		limiter = newQueryLimiter(maxConcurrentQueries, queriesPerSecond)
+		sharedLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// evictIdleLimiters removes the shared limiters without any query in flight that have not been used for
+// limiterIdleTimeout. A client still holding an evicted limiter keeps using it. It must be called with
+// sharedLimitersLock held.
+func evictIdleLimiters(now time.Time) {
+	for key, limiter := range sharedLimiters {
+		if limiter.inFlight() == 0 && now.Sub(time.Unix(0, limiter.lastUsed.Load())) > limiterIdleTimeout {
+			delete(sharedLimiters, key)
+		}
+	}
+}
+
+func (l *queryLimiter) touch() {
+	l.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (l *queryLimiter) inFlight() int {
+	if l == nil || l.slots == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// saturated tells whether the maximum number of concurrent queries are in flight, so that a new query would
+// wait for one of them to complete
+func (l *queryLimiter) saturated() bool {
+	return l != nil && l.slots != nil && len(l.slots) == cap(l.slots)
+}
+
+// acquire waits until a query can be sent to the server, and returns the function to call when the query
+// has completed. It returns an error if the context is done before.
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.touch()
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() {
+				<-l.slots
+				l.touch()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if l.rate != nil {
+		if err := l.rate.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
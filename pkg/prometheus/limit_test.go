@@ -0,0 +1,102 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxConcurrentQueries(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithRateLimit(2, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Query(context.Background(), "up")
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxInFlight.Load())
+}
+
+func TestQueriesPerSecond(t *testing.T) {
+	var requests atomic.Int32
+	server := newStatusServer(&requests)
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithRateLimit(0, 20)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := client.Query(context.Background(), "up")
+		assert.Nil(t, err)
+	}
+	// The first query is sent immediately, the next ones every 50ms
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestQueryLimiterCancelled(t *testing.T) {
+	limiter := newQueryLimiter(1, 0)
+	release, err := limiter.acquire(context.Background())
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	release()
+	release, err = limiter.acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+	assert.Nil(t, newQueryLimiter(0, 0))
+}
+
+func TestRateLimitIsShared(t *testing.T) {
+	newClient := func(host string) *RestClient {
+		client, err := NewRestClient(host, "")
+		assert.Nil(t, err)
+		return client
+	}
+	// The clients created again for each configuration object and each reload share the limits of the server
+	limiter := newClient("http://shared:9090").WithRateLimit(2, 5).limiter
+	assert.NotNil(t, limiter)
+	assert.Same(t, limiter, newClient("http://shared:9090").WithRateLimit(2, 5).limiter)
+	assert.NotSame(t, limiter, newClient("http://other:9090").WithRateLimit(2, 5).limiter)
+	assert.NotSame(t, limiter, newClient("http://shared:9090").WithRateLimit(4, 5).limiter)
+	assert.Nil(t, newClient("http://shared:9090").WithRateLimit(0, 0).limiter)
+}
+
+func TestIdleSharedLimitersAreEvicted(t *testing.T) {
+	idle := sharedQueryLimiter("http://idle:9090", 1, 0)
+	busy := sharedQueryLimiter("http://busy:9090", 1, 0)
+	release, err := busy.acquire(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, busy.saturated())
+	sharedLimitersLock.Lock()
+	evictIdleLimiters(time.Now().Add(limiterIdleTimeout + time.Minute))
+	sharedLimitersLock.Unlock()
+	// The limiter with a query in flight is kept
+	assert.NotSame(t, idle, sharedQueryLimiter("http://idle:9090", 1, 0))
+	assert.Same(t, busy, sharedQueryLimiter("http://busy:9090", 1, 0))
+	release()
+	assert.False(t, busy.saturated())
+}
@@ -0,0 +1,211 @@
+package prometheus
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Timeout of a request to the token endpoint
+	oauth2Timeout = 30 * time.Second
+	// Maximum period before the expiry of an access token when it is refreshed
+	oauth2MaxExpiryDelta = time.Minute
+	// Period before the token is requested again after a failed refresh, while the last token is still valid
+	oauth2RetryInterval = 10 * time.Second
+)
+
+// OAuth2Config is the client credentials grant (RFC 6749, section 4.4) that an access token is obtained with
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// oauth2TokenResponse is the successful response of the token endpoint (RFC 6749, section 5.1)
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// Lifetime in seconds of the access token; the token does not expire if 0
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// oauth2ErrorResponse is the error response of the token endpoint (RFC 6749, section 5.2)
+type oauth2ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oauth2Token is an access token obtained with the client credentials grant. The token is cached until shortly
+// before it expires, or until the server rejects it.
+type oauth2Token struct {
+	config OAuth2Config
+	client *http.Client
+	// Held while the token is read or requested; a channel so that the callers stop waiting when their context
+	// is done
+	lock  chan struct{}
+	token string
+	// The token is requested again after this time; never if zero
+	refreshTime time.Time
+	// The token cannot be used after this time; never if zero
+	expiry time.Time
+}
+
+// NewOAuth2TokenSource returns a TokenSource of the access tokens obtained from the token endpoint with the client
+// credentials. The token endpoint is verified against the system CAs, or with the TLS configuration of the
+// RestClient that the source is set on.
+func NewOAuth2TokenSource(config OAuth2Config) (TokenSource, error) {
+	if config.TokenURL == "" {
+		return nil, fmt.Errorf("missing token URL of OAuth2 client %v", config.ClientID)
+	}
+	if u, err := url.Parse(config.TokenURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid token URL %v", config.TokenURL)
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("missing client ID of OAuth2 token URL %v", config.TokenURL)
+	}
+	return &oauth2Token{
+		config: config,
+		client: &http.Client{Timeout: oauth2Timeout},
+		lock:   make(chan struct{}, 1),
+	}, nil
+}
+
+func (t *oauth2Token) acquire(ctx context.Context) error {
+	select {
+	case t.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("token of %v is not obtained in time: %w", t.config.TokenURL, ctx.Err())
+	}
+}
+
+func (t *oauth2Token) release() {
+	<-t.lock
+}
+
+// setTLSConfig sends the token requests with the TLS configuration of the client, e.g. to trust a private CA.
+// The name of the server is left to the host of the token URL.
+func (t *oauth2Token) setTLSConfig(tlsConfig *tls.Config) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = ""
+	t.lock <- struct{}{}
+	defer t.release()
+	t.client = &http.Client{
+		Transport: newTransport(tlsConfig),
+		Timeout:   oauth2Timeout,
+	}
+}
+
+func (t *oauth2Token) Token(ctx context.Context) (string, error) {
+	if err := t.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer t.release()
+	now := time.Now()
+	valid := t.token != "" && (t.expiry.IsZero() || now.Before(t.expiry))
+	if valid && (t.refreshTime.IsZero() || now.Before(t.refreshTime)) {
+		return t.token, nil
+	}
+	if err := t.requestToken(ctx); err != nil {
+		if valid {
+			glog.Warningf("Failed to refresh the access token, keep using the last token until %v: %v.",
+				t.expiry, err)
+			t.refreshTime = now.Add(oauth2RetryInterval)
+			return t.token, nil
+		}
+		return "", err
+	}
+	return t.token, nil
+}
+
+func (t *oauth2Token) Refresh(ctx context.Context, rejected string) (bool, error) {
+	if err := t.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer t.release()
+	if t.token != rejected {
+		// Already refreshed by another request
+		return true, nil
+	}
+	if err := t.requestToken(ctx); err != nil {
+		return false, err
+	}
+	return t.token != rejected, nil
+}
+
+func (t *oauth2Token) identity() string {
+	return "oauth2:" + t.config.TokenURL + "|" + t.config.ClientID
+}
+
+// requestToken obtains a new access token from the token endpoint, within the context of the query
+func (t *oauth2Token) requestToken(ctx context.Context) error {
+	params := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.config.Scopes) > 0 {
+		params.Set("scope", strings.Join(t.config.Scopes, " "))
+	}
+	ctx, cancel := context.WithTimeout(ctx, oauth2Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.TokenURL,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create token request to %v: %v", t.config.TokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// The client credentials are form-encoded in the basic authentication (RFC 6749, section 2.3.1)
+	req.SetBasicAuth(url.QueryEscape(t.config.ClientID), url.QueryEscape(t.config.ClientSecret))
+
+	requestTime := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send token request to %v: %w", t.config.TokenURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read token response from %v: %v", t.config.TokenURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp oauth2ErrorResponse
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+			return fmt.Errorf("token request to %v failed with status %d: %v %v",
+				t.config.TokenURL, resp.StatusCode, errResp.Error, errResp.ErrorDescription)
+		}
+		return fmt.Errorf("token request to %v failed with status %d: %s", t.config.TokenURL, resp.StatusCode, body)
+	}
+	var tokenResp oauth2TokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return fmt.Errorf("failed to decode token response from %v: %v", t.config.TokenURL, err)
+	}
+	if tokenResp.AccessToken == "" {
+		return fmt.Errorf("no access token in the token response from %v", t.config.TokenURL)
+	}
+	if tokenResp.TokenType != "" && !strings.EqualFold(tokenResp.TokenType, "bearer") {
+		return fmt.Errorf("unsupported token type %q from %v", tokenResp.TokenType, t.config.TokenURL)
+	}
+	t.token = tokenResp.AccessToken
+	t.refreshTime, t.expiry = time.Time{}, time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		// The lifetime starts when the request is sent, and the token is refreshed before it expires
+		lifetime := time.Duration(tokenResp.ExpiresIn) * time.Second
+		expiryDelta := lifetime / 10
+		if expiryDelta > oauth2MaxExpiryDelta {
+			expiryDelta = oauth2MaxExpiryDelta
+		}
+		t.expiry = requestTime.Add(lifetime)
+		t.refreshTime = t.expiry.Add(-expiryDelta)
+	}
+	glog.V(3).Infof("Obtained access token (len=%d) from %v, expires at %v.",
+		len(t.token), t.config.TokenURL, t.expiry)
+	return nil
+}
@@ -0,0 +1,183 @@
+package prometheus
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTokenServer returns a fake token endpoint issuing the access tokens token-1, token-2... that expire
+// after expiresIn seconds
+func newTokenServer(t *testing.T, tokens *atomic.Int32, expiresIn int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The credentials are form-encoded in the basic authentication
+		clientID, clientSecret, _ := r.BasicAuth()
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+		if r.Method != http.MethodPost || r.FormValue("grant_type") != "client_credentials" ||
+			clientID != "prometurbo" || clientSecret != "s3cr=t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		assert.Equal(t, "metrics.read tenant", r.FormValue("scope"))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", tokens.Add(1)),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+		})
+	}))
+}
+
+func newTestOAuth2Token(t *testing.T, tokenURL, clientSecret string) *oauth2Token {
+	source, err := NewOAuth2TokenSource(OAuth2Config{
+		TokenURL:     tokenURL,
+		ClientID:     "prometurbo",
+		ClientSecret: clientSecret,
+		Scopes:       []string{"metrics.read", "tenant"},
+	})
+	assert.Nil(t, err)
+	return source.(*oauth2Token)
+}
+
+func TestOAuth2TokenIsCached(t *testing.T) {
+	var tokens atomic.Int32
+	server := newTokenServer(t, &tokens, 3600)
+	defer server.Close()
+	source := newTestOAuth2Token(t, server.URL, "s3cr=t")
+	for i := 0; i < 3; i++ {
+		token, err := source.Token(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, "token-1", token)
+	}
+	// The token is refreshed a minute before it expires
+	assert.Equal(t, time.Minute, source.expiry.Sub(source.refreshTime))
+	source.refreshTime = time.Now()
+	token, _ := source.Token(context.Background())
+	assert.Equal(t, "token-2", token)
+	// A rejected token is replaced only once
+	rotated, err := source.Refresh(context.Background(), "token-2")
+	assert.Nil(t, err)
+	assert.True(t, rotated)
+	rotated, _ = source.Refresh(context.Background(), "token-2")
+	assert.True(t, rotated)
+	assert.Equal(t, int32(3), tokens.Load())
+}
+
+func TestOAuth2TokenErrors(t *testing.T) {
+	var tokens atomic.Int32
+	server := newTokenServer(t, &tokens, 10)
+	defer server.Close()
+	_, err := newTestOAuth2Token(t, server.URL, "wrong").Token(context.Background())
+	assert.ErrorContains(t, err, "invalid_client")
+	_, err = NewOAuth2TokenSource(OAuth2Config{TokenURL: "token", ClientID: "prometurbo"})
+	assert.NotNil(t, err)
+
+	// The last token is used until it expires if it cannot be refreshed
+	source := newTestOAuth2Token(t, server.URL, "s3cr=t")
+	token, _ := source.Token(context.Background())
+	assert.Equal(t, time.Second, source.expiry.Sub(source.refreshTime))
+	source.config.ClientSecret = "wrong"
+	source.refreshTime = time.Now()
+	current, err := source.Token(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, token, current)
+	source.expiry = time.Now()
+	_, err = source.Token(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestQueryWithOAuth2Token(t *testing.T) {
+	var tokens atomic.Int32
+	tokenServer := newTokenServer(t, &tokens, 3600)
+	defer tokenServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first token is revoked
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithTokenSource(newTestOAuth2Token(t, tokenServer.URL, "s3cr=t"))
+	_, err := client.Query(context.Background(), "up")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), tokens.Load())
+}
+
+func TestOAuth2TokenWithTLSConfigOfClient(t *testing.T) {
+	var tokens atomic.Int32
+	plainServer := newTokenServer(t, &tokens, 3600)
+	defer plainServer.Close()
+	server := httptest.NewTLSServer(plainServer.Config.Handler)
+	defer server.Close()
+	source := newTestOAuth2Token(t, server.URL, "s3cr=t")
+	// The certificate of the token endpoint is not signed by a system CA
+	_, err := source.Token(context.Background())
+	assert.NotNil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	client, err := NewRestClient("http://prometheus:9090", "")
+	assert.Nil(t, err)
+	// The server name of the Prometheus server is not used to verify the token endpoint
+	client.WithTokenSource(source).WithTLSConfig(&tls.Config{RootCAs: pool, ServerName: "prometheus"})
+	token, err := source.Token(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+}
+
+func TestOAuth2TokenWithinContext(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	source := newTestOAuth2Token(t, server.URL, "s3cr=t")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := source.Token(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), oauth2Timeout)
+
+	// The callers waiting for the token stop waiting with their query
+	source.lock <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = source.Token(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = source.Refresh(ctx, "")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	source.release()
+}
+
+func TestTokenFileDoesNotReplaceOAuth2Token(t *testing.T) {
+	tokenFolder := prometheusTokenFolder
+	defer func() { prometheusTokenFolder = tokenFolder }()
+	prometheusTokenFolder = t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(prometheusTokenFolder, "prometheus"), []byte("file-token"), 0600))
+	source := newTestOAuth2Token(t, "https://idp/token", "s3cr=t")
+	client, err := NewRestClientWithTokenSource("http://prometheus:9090", source)
+	assert.Nil(t, err)
+	assert.Equal(t, TokenSource(source), client.token)
+	// The file still overrides the other tokens
+	client, err = NewRestClient("http://prometheus:9090", "configured")
+	assert.Nil(t, err)
+	token, err := client.getToken(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "file-token", token)
+}
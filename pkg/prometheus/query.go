@@ -0,0 +1,359 @@
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// PromQL keywords that can never be the name of a vector selector
+	promQLKeywords = map[string]bool{
+		"and": true, "or": true, "unless": true, "atan2": true,
+		"bool": true, "offset": true, "inf": true, "nan": true,
+		"by": true, "without": true, "on": true, "ignoring": true,
+		"group_left": true, "group_right": true,
+		"sum": true, "avg": true, "count": true, "min": true, "max": true,
+		"group": true, "stddev": true, "stdvar": true, "topk": true,
+		"bottomk": true, "count_values": true, "quantile": true,
+		"limitk": true, "limit_ratio": true,
+	}
+
+	// PromQL aggregation operators, which are followed by their parameters or by a grouping keyword
+	promQLAggregations = map[string]bool{
+		"sum": true, "avg": true, "count": true, "min": true, "max": true,
+		"group": true, "stddev": true, "stdvar": true, "topk": true,
+		"bottomk": true, "count_values": true, "quantile": true,
+		"limitk": true, "limit_ratio": true,
+	}
+
+	// PromQL keywords that are followed by a parenthesized list of label names
+	promQLGroupingKeywords = map[string]bool{
+		"by": true, "without": true, "on": true, "ignoring": true,
+		"group_left": true, "group_right": true,
+	}
+
+	// PromQL functions, whose names are only supported as function calls
+	promQLFunctions = map[string]bool{
+		"abs": true, "absent": true, "absent_over_time": true, "acos": true, "acosh": true, "asin": true,
+		"asinh": true, "atan": true, "atanh": true, "avg_over_time": true, "ceil": true, "changes": true,
+		"clamp": true, "clamp_max": true, "clamp_min": true, "cos": true, "cosh": true,
+		"count_over_time": true, "day_of_month": true, "day_of_week": true, "day_of_year": true,
+		"days_in_month": true, "deg": true, "delta": true, "deriv": true,
+		"double_exponential_smoothing": true, "exp": true, "floor": true, "histogram_avg": true,
+		"histogram_count": true, "histogram_fraction": true, "histogram_quantile": true,
+		"histogram_stddev": true, "histogram_stdvar": true, "histogram_sum": true, "holt_winters": true,
+		"hour": true, "idelta": true, "increase": true, "info": true, "irate": true, "label_join": true,
+		"label_replace": true, "last_over_time": true, "ln": true, "log10": true, "log2": true,
+		"mad_over_time": true, "max_over_time": true, "min_over_time": true, "minute": true, "month": true,
+		"pi": true, "predict_linear": true, "present_over_time": true, "quantile_over_time": true,
+		"rad": true, "rate": true, "resets": true, "round": true, "scalar": true, "sgn": true, "sin": true,
+		"sinh": true, "sort": true, "sort_by_label": true, "sort_by_label_desc": true, "sort_desc": true,
+		"sqrt": true, "stddev_over_time": true, "stdvar_over_time": true, "sum_over_time": true,
+		"tan": true, "tanh": true, "time": true, "timestamp": true, "vector": true, "year": true,
+	}
+)
+
+// InjectLabelMatchers rewrites a PromQL query so that every vector selector in it carries the given
+// equality label matchers, e.g. with {"cluster": "clusterA"}:
+//
+//	rate(http_requests_total{code="200"}[1m]) / on(pod) kube_pod_info
+//
+// becomes
+//
+//	rate(http_requests_total{code="200",cluster="clusterA"}[1m]) / on(pod) kube_pod_info{cluster="clusterA"}
+//
+// The query is tokenized just enough to tell selectors apart from function calls, aggregation
+// operators, keywords, label lists, string literals and range/subquery durations. The PromQL parser of
+// github.com/prometheus/prometheus would find the selectors in the syntax tree instead, but it cannot be
+// vendored: it pulls in most of the Prometheus server. Instead of leaving a selector unscoped, the constructs
+// that the tokenizer cannot tell apart are rejected with an error:
+//   - a metric named like a function or an aggregation operator, e.g. rate{job="a"}, which must be selected
+//     by its name, e.g. {__name__="rate",job="a"};
+//   - a selector that already has a matcher on one of the given labels, e.g. up{cluster="clusterB"}.
+func InjectLabelMatchers(query string, labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return query, nil
+	}
+	matchers, err := formatLabelMatchers(labels)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end, err := skipString(query, i)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(query[i:end])
+			i = end
+		case c == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			out.WriteString(query[i : i+end])
+			i += end
+		case c == '[':
+			// Range or subquery durations are copied verbatim
+			end := strings.IndexByte(query[i:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed '[' at position %d in query %q", i, query)
+			}
+			out.WriteString(query[i : i+end+1])
+			i += end + 1
+		case c == '{':
+			// A selector without a metric name, e.g. {__name__=~"job:.*"}
+			end, err := writeSelectorMatchers(&out, query, i, labels, matchers)
+			if err != nil {
+				return "", err
+			}
+			i = end
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			end := skipNumber(query, i)
+			out.WriteString(query[i:end])
+			i = end
+		case isIdentifierStart(c):
+			end := skipIdentifier(query, i)
+			ident := query[i:end]
+			out.WriteString(ident)
+			i = end
+			next := skipSpaces(query, i)
+			lowerIdent := strings.ToLower(ident)
+			if promQLAggregations[lowerIdent] {
+				if next < len(query) && query[next] == '(' {
+					continue
+				}
+				if end := skipIdentifier(query, next); promQLGroupingKeywords[strings.ToLower(query[next:end])] {
+					continue
+				}
+				return "", fmt.Errorf("unsupported metric name %q at position %d in query %q: "+
+					"select the metric with {__name__=%q}", ident, i-len(ident), query, ident)
+			}
+			if promQLGroupingKeywords[lowerIdent] {
+				if next < len(query) && query[next] == '(' {
+					closing := strings.IndexByte(query[next:], ')')
+					if closing < 0 {
+						return "", fmt.Errorf("unclosed label list after %q in query %q", ident, query)
+					}
+					out.WriteString(query[i : next+closing+1])
+					i = next + closing + 1
+				}
+				continue
+			}
+			if promQLKeywords[lowerIdent] {
+				continue
+			}
+			if next < len(query) && query[next] == '(' {
+				// Function call
+				continue
+			}
+			if promQLFunctions[ident] {
+				return "", fmt.Errorf("unsupported metric name %q at position %d in query %q: "+
+					"select the metric with {__name__=%q}", ident, i-len(ident), query, ident)
+			}
+			if next < len(query) && query[next] == '{' {
+				out.WriteString(query[i:next])
+				end, err := writeSelectorMatchers(&out, query, next, labels, matchers)
+				if err != nil {
+					return "", err
+				}
+				i = end
+				continue
+			}
+			out.WriteString("{" + matchers + "}")
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+// IsVectorSelector tells whether the query is a single instant vector selector, e.g. up{job="prometheus"},
+// without any function, operator, range, offset or @ modifier. The samples returned for such a query are the
+// samples of the series themselves, so that timestamp() of the query returns the times of the samples.
+func IsVectorSelector(query string) bool {
+	query = strings.TrimSpace(query)
+	i := 0
+	if i < len(query) && isIdentifierStart(query[i]) {
+		for i < len(query) && isIdentifierChar(query[i]) {
+			i++
+		}
+		if promQLKeywords[strings.ToLower(query[:i])] {
+			return false
+		}
+		i = skipSpaces(query, i)
+	}
+	if i < len(query) && query[i] == '{' {
+		end, err := selectorEnd(query, i)
+		if err != nil {
+			return false
+		}
+		i = end + 1
+	}
+	return i > 0 && i == len(query)
+}
+
+// writeSelectorMatchers writes the label matchers enclosed by the braces starting at position start,
+// with the injected matchers appended, and returns the position right after the closing brace.
+// It fails if the selector already has a matcher on one of the injected labels.
+func writeSelectorMatchers(out *strings.Builder, query string, start int, labels map[string]string,
+	matchers string) (int, error) {
+	i, err := selectorEnd(query, start)
+	if err != nil {
+		return 0, err
+	}
+	existing := strings.TrimSpace(query[start+1 : i])
+	for _, name := range matcherLabelNames(existing) {
+		if _, found := labels[name]; found {
+			return 0, fmt.Errorf("unsupported selector %q at position %d in query %q: "+
+				"it already has a matcher on label %q", query[start:i+1], start, query, name)
+		}
+	}
+	out.WriteByte('{')
+	if existing != "" {
+		out.WriteString(existing)
+		if !strings.HasSuffix(existing, ",") {
+			out.WriteByte(',')
+		}
+	}
+	out.WriteString(matchers)
+	out.WriteByte('}')
+	return i + 1, nil
+}
+
+// matcherLabelNames returns the label names of the label matchers enclosed by the braces of a selector
+func matcherLabelNames(matchers string) []string {
+	var names []string
+	for i := skipSpaces(matchers, 0); i < len(matchers); i = skipSpaces(matchers, i) {
+		c := matchers[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			// A quoted label name, or the value of a matcher
+			end, err := skipString(matchers, i)
+			if err != nil {
+				return names
+			}
+			if next := skipSpaces(matchers, end); next < len(matchers) && strings.IndexByte("=!~", matchers[next]) >= 0 {
+				if name, err := strconv.Unquote(matchers[i:end]); err == nil {
+					names = append(names, name)
+				}
+			}
+			i = end
+		case isIdentifierStart(c):
+			end := skipIdentifier(matchers, i)
+			names = append(names, matchers[i:end])
+			i = end
+		default:
+			i++
+		}
+	}
+	return names
+}
+
+// selectorEnd returns the position of the brace closing the label matchers that start at position start
+func selectorEnd(query string, start int) (int, error) {
+	i := start + 1
+	for i < len(query) && query[i] != '}' {
+		if c := query[i]; c == '"' || c == '\'' || c == '`' {
+			end, err := skipString(query, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+			continue
+		}
+		i++
+	}
+	if i >= len(query) {
+		return 0, fmt.Errorf("unclosed '{' at position %d in query %q", start, query)
+	}
+	return i, nil
+}
+
+func formatLabelMatchers(labels map[string]string) (string, error) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !labelNameRegex.MatchString(name) {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	matchers := make([]string, 0, len(names))
+	for _, name := range names {
+		matchers = append(matchers, name+"="+strconv.Quote(labels[name]))
+	}
+	return strings.Join(matchers, ","), nil
+}
+
+// skipString returns the position right after the string literal starting at position start
+func skipString(query string, start int) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		if query[i] == '\\' && quote != '`' {
+			i++
+			continue
+		}
+		if query[i] == quote {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string literal at position %d in query %q", start, query)
+}
+
+// skipNumber returns the position right after the number or duration starting at position start,
+// e.g. 1000.0, 1e-3, 0x1f or 1h30m
+func skipNumber(query string, start int) int {
+	i := start
+	for i < len(query) {
+		c := query[i]
+		if isIdentifierChar(c) && c != ':' || c == '.' {
+			i++
+			continue
+		}
+		if (c == '+' || c == '-') && (query[i-1] == 'e' || query[i-1] == 'E') &&
+			!strings.HasPrefix(strings.ToLower(query[start:]), "0x") {
+			i++
+			continue
+		}
+		break
+	}
+	return i
+}
+
+func skipIdentifier(query string, start int) int {
+	i := start
+	for i < len(query) && isIdentifierChar(query[i]) {
+		i++
+	}
+	return i
+}
+
+func skipSpaces(query string, start int) int {
+	i := start
+	for i < len(query) && (query[i] == ' ' || query[i] == '\t' || query[i] == '\n' || query[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
@@ -0,0 +1,141 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInjectLabelMatchers(t *testing.T) {
+	labels := map[string]string{
+		"cluster": "clusterA",
+	}
+	queries := []struct {
+		input          string
+		expectedOutput string
+	}{
+		{
+			"java_lang_OperatingSystem_ProcessCpuLoad",
+			`java_lang_OperatingSystem_ProcessCpuLoad{cluster="clusterA"}`,
+		},
+		{
+			"java_lang_Memory_HeapMemoryUsage_used/1024",
+			`java_lang_Memory_HeapMemoryUsage_used{cluster="clusterA"}/1024`,
+		},
+		{
+			`rate(istio_requests_total{request_protocol="http",response_code="200"}[1m]) > 0`,
+			`rate(istio_requests_total{request_protocol="http",response_code="200",cluster="clusterA"}[1m]) > 0`,
+		},
+		{
+			`rate(istio_request_duration_milliseconds_sum{reporter="destination"}[1m])/rate(istio_request_duration_milliseconds_count{}[1m]) >= 0`,
+			`rate(istio_request_duration_milliseconds_sum{reporter="destination",cluster="clusterA"}[1m])/rate(istio_request_duration_milliseconds_count{cluster="clusterA"}[1m]) >= 0`,
+		},
+		{
+			`sum without (name) (delta(java_lang_GarbageCollector_CollectionTime[10m]))/600*100`,
+			`sum without (name) (delta(java_lang_GarbageCollector_CollectionTime{cluster="clusterA"}[10m]))/600*100`,
+		},
+		{
+			`1000.0*rate(istio_turbo_pod_latency_time_ms_sum{response_code="200"}[3m] offset 5m)`,
+			`1000.0*rate(istio_turbo_pod_latency_time_ms_sum{response_code="200",cluster="clusterA"}[3m] offset 5m)`,
+		},
+		{
+			`sum by (pod) (rate(http_requests_total{path=~"/api/{id}"}[5m])) * on(pod) group_left(node) kube_pod_info`,
+			`sum by (pod) (rate(http_requests_total{path=~"/api/{id}",cluster="clusterA"}[5m])) * on(pod) group_left(node) kube_pod_info{cluster="clusterA"}`,
+		},
+		{
+			`{__name__=~"job:.*"} > bool 1e-3`,
+			`{__name__=~"job:.*",cluster="clusterA"} > bool 1e-3`,
+		},
+		{
+			`label_replace(up, "host", "$1", "instance", "(.*):.*")`,
+			`label_replace(up{cluster="clusterA"}, "host", "$1", "instance", "(.*):.*")`,
+		},
+		{
+			`max_over_time(node:cpu:rate5m[1h:5m])`,
+			`max_over_time(node:cpu:rate5m{cluster="clusterA"}[1h:5m])`,
+		},
+	}
+	for _, query := range queries {
+		output, err := InjectLabelMatchers(query.input, labels)
+		assert.Nil(t, err)
+		assert.Equal(t, query.expectedOutput, output)
+	}
+}
+
+func TestInjectMultipleLabelMatchers(t *testing.T) {
+	labels := map[string]string{
+		"region":  "us-west-2",
+		"cluster": "production",
+	}
+	output, err := InjectLabelMatchers(`up{job="node",}`, labels)
+	assert.Nil(t, err)
+	assert.Equal(t, `up{job="node",cluster="production",region="us-west-2"}`, output)
+}
+
+func TestInjectLabelMatchersWithNoLabels(t *testing.T) {
+	output, err := InjectLabelMatchers("up", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "up", output)
+}
+
+func TestInjectLabelMatchersWithInvalidInput(t *testing.T) {
+	_, err := InjectLabelMatchers("up", map[string]string{"cluster-name": "clusterA"})
+	assert.NotNil(t, err)
+	_, err = InjectLabelMatchers(`up{job="node"`, map[string]string{"cluster": "clusterA"})
+	assert.NotNil(t, err)
+	_, err = InjectLabelMatchers(`up{job="node}`, map[string]string{"cluster": "clusterA"})
+	assert.NotNil(t, err)
+}
+
+func TestInjectLabelMatchersWithUnsupportedConstructs(t *testing.T) {
+	labels := map[string]string{"cluster": "clusterA"}
+	for _, query := range []string{
+		// Metrics named like a function or an aggregation operator
+		`rate{job="node"}`,
+		`time`,
+		`sum(rate(rate{job="node"}[5m]))`,
+		`count{job="node"}`,
+		`up / min`,
+		// Selectors with a matcher on an injected label
+		`up{cluster="clusterB"}`,
+		`up{job="node", cluster=~"cluster.*"}`,
+		`{"cluster"!="clusterB"}`,
+		`sum(rate(http_requests_total{code="200",cluster="clusterB"}[5m]))`,
+	} {
+		_, err := InjectLabelMatchers(query, labels)
+		assert.NotNil(t, err, query)
+	}
+	// The same names are supported as function calls, aggregation operators, label values and other labels
+	output, err := InjectLabelMatchers(
+		`sum by (job) (rate(up{job="rate",subcluster="time"}[5m])) > bool count without (job) (time() - up)`, labels)
+	assert.Nil(t, err)
+	assert.Equal(t, `sum by (job) (rate(up{job="rate",subcluster="time",cluster="clusterA"}[5m])) > bool `+
+		`count without (job) (time() - up{cluster="clusterA"})`, output)
+}
+
+func TestIsVectorSelector(t *testing.T) {
+	for _, query := range []string{
+		`up`,
+		` up{job="node"} `,
+		`{__name__=~"job:.*"}`,
+		`http_requests_total{path="/a}b", code!~'5..'}`,
+	} {
+		assert.True(t, IsVectorSelector(query), query)
+	}
+	for _, query := range []string{
+		``,
+		`1`,
+		`"up"`,
+		`up[5m]`,
+		`up offset 5m`,
+		`up @ 1609746000`,
+		`up > 0`,
+		`rate(http_requests_total[5m])`,
+		`sum(up)`,
+		`sum`,
+		`up{job="node"`,
+		`up{job="node"} or down`,
+	} {
+		assert.False(t, IsVectorSelector(query), query)
+	}
+}
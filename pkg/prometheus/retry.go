@@ -0,0 +1,162 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultMaxRetries       = 2
+	defaultInitialBackoff   = 500 * time.Millisecond
+	defaultMaxBackoff       = 5 * time.Second
+	DefaultFailureThreshold = 5
+	defaultCooldown         = 2 * time.Minute
+)
+
+// ErrCircuitOpen is returned without sending the query when the circuit breaker of the server is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// retryPolicy retries the queries that failed because the server is unavailable or overloaded, waiting for an
+// exponentially growing, jittered backoff between the attempts
+type retryPolicy struct {
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// backoff returns the time to wait before the given retry, starting from 1. Half of the exponential backoff is
+// randomized, so that the clients failing at the same time do not retry at the same time.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	backoff := p.initialBackoff
+	for i := 1; i < retry && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// isRetryable tells whether a query that failed with the given error may succeed if it is sent again:
+// a connection error, a timeout, a 5xx status or a 429 (Too Many Requests) status
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError ||
+			httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops sending queries to a server for a cooldown period after a number of consecutive failures.
+// Once the cooldown period has elapsed, a single trial query is let through: the breaker is closed again if it
+// succeeds, or opened for another cooldown period if it fails. A trial query without an outcome is aborted, so
+// that the next query is the trial.
+type circuitBreaker struct {
+	failureThreshold int
+	cooldown         time.Duration
+	lock             sync.Mutex
+	state            circuitState
+	failures         int
+	openedAt         time.Time
+	now              func() time.Time
+}
+
+// newCircuitBreaker returns a circuit breaker, or nil if the failure threshold is not positive, in which case
+// the breaker is disabled
+func newCircuitBreaker(failureThreshold int, cooldown time.Duration) *circuitBreaker {
+	if failureThreshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+	}
+}
+
+// allow returns ErrCircuitOpen if a query must not be sent. It returns true if the query is the trial query,
+// whose outcome must then be either recorded or aborted.
+func (b *circuitBreaker) allow() (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if remaining := b.cooldown - b.now().Sub(b.openedAt); remaining > 0 {
+			return false, fmt.Errorf("%w after %d consecutive failures, retrying in %v",
+				ErrCircuitOpen, b.failures, remaining.Round(time.Second))
+		}
+		// Let a trial query through
+		b.state = circuitHalfOpen
+		return true, nil
+	case circuitHalfOpen:
+		return false, fmt.Errorf("%w, waiting for the trial query", ErrCircuitOpen)
+	}
+	return false, nil
+}
+
+// abortTrial opens the breaker again when the trial query has no outcome, e.g. when it is cancelled or not sent.
+// The cooldown period has already elapsed, so the next query is let through as the trial.
+func (b *circuitBreaker) abortTrial() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+	}
+}
+
+// record records the outcome of a query; only the failures caused by an unavailable server count
+func (b *circuitBreaker) record(err error, host string) {
+	if b == nil || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !isRetryable(err) {
+		if b.state != circuitClosed {
+			glog.V(2).Infof("Closing circuit breaker of %v.", host)
+		}
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.failureThreshold {
+		if b.state != circuitOpen {
+			glog.Warningf("Opening circuit breaker of %v for %v after %d consecutive failures: %v.",
+				host, b.cooldown, b.failures, err)
+		}
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
@@ -0,0 +1,212 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := retryPolicy{maxRetries: 5, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		backoff := policy.backoff(retry + 1)
+		assert.True(t, backoff >= max/2 && backoff <= max, "retry %d: %v", retry+1, backoff)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(&HTTPError{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, isRetryable(&HTTPError{StatusCode: http.StatusTooManyRequests}))
+	assert.True(t, isRetryable(context.DeadlineExceeded))
+	assert.False(t, isRetryable(&HTTPError{StatusCode: http.StatusBadRequest}))
+	assert.False(t, isRetryable(&HTTPError{StatusCode: http.StatusUnauthorized}))
+	assert.False(t, isRetryable(context.Canceled))
+	assert.False(t, isRetryable(ErrCircuitOpen))
+	assert.False(t, isRetryable(errors.New("prometheus API returned an error")))
+	assert.False(t, isRetryable(nil))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	unavailable := &HTTPError{StatusCode: http.StatusBadGateway}
+	allow := func() error {
+		_, err := breaker.allow()
+		return err
+	}
+
+	breaker.record(unavailable, "host")
+	assert.Nil(t, allow())
+	// A successful query resets the consecutive failures
+	breaker.record(nil, "host")
+	breaker.record(unavailable, "host")
+	assert.Nil(t, allow())
+	breaker.record(unavailable, "host")
+	assert.True(t, errors.Is(allow(), ErrCircuitOpen))
+
+	// A single trial query is let through after the cooldown period
+	now = now.Add(time.Minute)
+	trial, err := breaker.allow()
+	assert.True(t, trial)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(allow(), ErrCircuitOpen))
+	breaker.record(unavailable, "host")
+	assert.True(t, errors.Is(allow(), ErrCircuitOpen))
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, allow())
+	// A query rejected by a reachable server closes the breaker
+	breaker.record(&HTTPError{StatusCode: http.StatusBadRequest}, "host")
+	assert.Nil(t, allow())
+	assert.Nil(t, allow())
+
+	// An aborted trial lets the next query through as the trial
+	now = now.Add(time.Minute)
+	breaker.record(unavailable, "host")
+	breaker.record(unavailable, "host")
+	now = now.Add(time.Minute)
+	trial, err = breaker.allow()
+	assert.True(t, trial)
+	assert.Nil(t, err)
+	breaker.abortTrial()
+	trial, err = breaker.allow()
+	assert.True(t, trial)
+	assert.Nil(t, err)
+
+	assert.Nil(t, newCircuitBreaker(0, time.Minute))
+	var disabled *circuitBreaker
+	disabled.record(unavailable, "host")
+	trial, err = disabled.allow()
+	assert.False(t, trial)
+	assert.Nil(t, err)
+}
+
+func newStatusServer(requests *atomic.Int32, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(requests.Add(1)) - 1
+		if i < len(statuses) && statuses[i] != http.StatusOK {
+			w.WriteHeader(statuses[i])
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+}
+
+func newTestRestClient(t *testing.T, host string) *RestClient {
+	client, err := NewRestClient(host, "")
+	assert.Nil(t, err)
+	client.retry.initialBackoff = time.Millisecond
+	client.retry.maxBackoff = time.Millisecond
+	return client
+}
+
+func TestQueryRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := newStatusServer(&requests, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+	_, err := newTestRestClient(t, server.URL).Query(context.Background(), "up")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+
+	requests.Store(0)
+	_, err = newTestRestClient(t, server.URL).WithRetry(1).Query(context.Background(), "up")
+	assert.Equal(t, http.StatusTooManyRequests, err.(*HTTPError).StatusCode)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestQueryDoesNotRetryClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := newStatusServer(&requests, http.StatusBadRequest)
+	defer server.Close()
+	_, err := newTestRestClient(t, server.URL).Query(context.Background(), "up")
+	assert.Equal(t, http.StatusBadRequest, err.(*HTTPError).StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestQueryWithOpenCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	server := newStatusServer(&requests, http.StatusInternalServerError, http.StatusInternalServerError,
+		http.StatusInternalServerError)
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithRetry(0).WithCircuitBreaker(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		_, err := client.Query(context.Background(), "up")
+		assert.NotNil(t, err)
+	}
+	_, err := client.Query(context.Background(), "up")
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestQueryTimeout(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+	_, err := newTestRestClient(t, server.URL).WithTimeout(10*time.Millisecond).WithRetry(1).Query(context.Background(), "up")
+	assert.True(t, isRetryable(err))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestQueryCancelled(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithCircuitBreaker(1, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Query(ctx, "up")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	// A cancelled query is neither retried nor counted as a failure of the server
+	assert.Equal(t, int32(1), requests.Load())
+	_, err = client.breaker.allow()
+	assert.Nil(t, err)
+}
+
+func TestCancelledTrialQuery(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			// The trial query does not complete before it is cancelled
+			<-r.Context().Done()
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}
+	}))
+	defer server.Close()
+	client := newTestRestClient(t, server.URL).WithRetry(0).WithCircuitBreaker(1, time.Hour)
+	now := time.Now()
+	client.breaker.now = func() time.Time { return now }
+	_, err := client.Query(context.Background(), "up")
+	assert.NotNil(t, err)
+	now = now.Add(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.Query(ctx, "up")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	// The breaker does not wait for the cancelled trial query forever
+	_, err = client.Query(context.Background(), "up")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
@@ -0,0 +1,207 @@
+package prometheus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	// Service name of Amazon Managed Service for Prometheus
+	defaultSigV4Service = "aps"
+	sigV4DateFormat     = "20060102T150405Z"
+	sigV4DayFormat      = "20060102"
+	// Hash of an empty payload, as the queries are sent without a body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// SigV4Config configures the AWS Signature Version 4 signing of the requests, as required by Amazon Managed
+// Service for Prometheus. The requests are signed with the static credentials if given, or else with the
+// credentials of the environment (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY), or else with the web identity of
+// the pod (IAM roles for service accounts of EKS). The role is assumed with these credentials if given.
+type SigV4Config struct {
+	Region string
+	// Static credentials; optional
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Role to assume; optional
+	RoleARN string
+	// Signing name of the service, "aps" if empty
+	Service string
+	// STS endpoint that the role is assumed with, the regional endpoint of AWS if empty
+	STSEndpoint string
+}
+
+// SigV4Signer signs the requests with AWS Signature Version 4
+type SigV4Signer struct {
+	region      string
+	service     string
+	credentials *awsCredentialsCache
+	// Identifies the credentials that the requests are signed with
+	identity string
+	now      func() time.Time
+}
+
+// NewSigV4Signer creates a signer of the requests sent to the region, resolving the credentials as described
+// by SigV4Config
+func NewSigV4Signer(config SigV4Config) (*SigV4Signer, error) {
+	if config.Region == "" {
+		return nil, fmt.Errorf("missing region of SigV4 signing")
+	}
+	service := config.Service
+	if service == "" {
+		service = defaultSigV4Service
+	}
+	credentials, identity, err := newAWSCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	return &SigV4Signer{
+		region:      config.Region,
+		service:     service,
+		credentials: credentials,
+		identity:    identity,
+		now:         time.Now,
+	}, nil
+}
+
+// sign adds the X-Amz-Date, the X-Amz-Security-Token and the Authorization headers of a request without a body.
+// The credentials are refreshed within the context of the request.
+func (s *SigV4Signer) sign(req *http.Request) error {
+	credentials, err := s.credentials.get(req.Context())
+	if err != nil {
+		return err
+	}
+	// url.Values.Encode encodes the spaces as "+", which AWS takes as a literal plus when it canonicalizes the
+	// received query, so the spaces are sent as "%20" like in the canonical query. A literal plus is encoded
+	// as "%2B" and is not affected.
+	req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, "+", "%20")
+	signV4(req, credentials, s.region, s.service, s.now().UTC())
+	return nil
+}
+
+// signV4 signs the request with the credentials, following
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func signV4(req *http.Request, credentials awsCredentials, region, service string, now time.Time) {
+	amzDate := now.Format(sigV4DateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	headers, signedHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		headers,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := strings.Join([]string{now.Format(sigV4DayFormat), region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hashHex(canonicalRequest)}, "\n")
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), now.Format(sigV4DayFormat))
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalHeaders returns the canonical headers and the signed headers of the request. The host, the content
+// type and the X-Amz-* headers are signed; the other headers can be changed by the transport or by proxies.
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, value := range values {
+				trimmed[i] = strings.Join(strings.Fields(value), " ")
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+// canonicalURI returns the path of the URL with each segment encoded twice, as required by all the services
+// other than S3
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns the parameters of the query, encoded and sorted by name and value
+func canonicalQuery(u *url.URL) string {
+	var params [][2]string
+	for name, values := range u.Query() {
+		for _, value := range values {
+			params = append(params, [2]string{uriEncode(name), uriEncode(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// uriEncode encodes all the characters except the unreserved characters of RFC 3986
+func uriEncode(s string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
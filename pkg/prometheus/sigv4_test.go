@@ -0,0 +1,159 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testAWSCredentials = awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	testSigningTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+func TestSignV4(t *testing.T) {
+	// Example of https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Version=2010-05-08&Action=ListUsers", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, testAWSCredentials, "us-east-1", "iam", testSigningTime)
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"))
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet,
+		"https://aps.example.com/workspaces/ws-1/api/v1/query?query=sum(rate(x[5m]))%20by%20(a)&b-c=2&b=1", nil)
+	assert.Equal(t, "/workspaces/ws-1/api/v1/query", canonicalURI(req.URL))
+	assert.Equal(t, "b=1&b-c=2&query=sum%28rate%28x%5B5m%5D%29%29%20by%20%28a%29", canonicalQuery(req.URL))
+	req.Header.Set("X-Scope-OrgID", "unsigned")
+	req.Header.Set("X-Amz-Security-Token", " token  with  spaces ")
+	headers, signedHeaders := canonicalHeaders(req)
+	assert.Equal(t, "host:aps.example.com\nx-amz-security-token:token with spaces\n", headers)
+	assert.Equal(t, "host;x-amz-security-token", signedHeaders)
+}
+
+// roundTripperFunc sends the requests of a client to a function instead of a server
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestQueryWithSigV4(t *testing.T) {
+	signer, err := NewSigV4Signer(SigV4Config{
+		Region:          "us-west-2",
+		AccessKeyID:     testAWSCredentials.AccessKeyID,
+		SecretAccessKey: testAWSCredentials.SecretAccessKey,
+		SessionToken:    "session",
+	})
+	assert.Nil(t, err)
+	signer.now = func() time.Time { return testSigningTime }
+	client := newTestRestClient(t, "https://aps-workspaces.us-west-2.amazonaws.com/workspaces/ws-1/api/v1/query").
+		WithSigV4Signer(signer)
+	var sent *http.Request
+	client.client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"status":"success","data":{"resultType":"vector","result":[]}}`)),
+			Request:    req,
+		}, nil
+	})
+	params := url.Values{}
+	params.Set("query", `sum by (job) (up{job="a+b"})`)
+	params.Set("time", "1440938160")
+	_, err = client.doQuery(context.Background(), client.host, params)
+	assert.Nil(t, err)
+	// The spaces are sent as in the canonical query, and the literal plus stays encoded
+	assert.Equal(t, "query=sum%20by%20%28job%29%20%28up%7Bjob%3D%22a%2Bb%22%7D%29&time=1440938160", sent.URL.RawQuery)
+	assert.Equal(t, "session", sent.Header.Get("X-Amz-Security-Token"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-west-2/aps/aws4_request, "+
+		"SignedHeaders=host;x-amz-date;x-amz-security-token, "+
+		"Signature=36d840e105e31e410f1a64b95e98f9e84923625b2914186e8a97de5d790b8c44",
+		sent.Header.Get("Authorization"))
+	assert.True(t, strings.HasSuffix(client.serverKey(), "|AKIDEXAMPLE"))
+}
+
+// newSTSServer returns a stand-in of STS, which issues the credentials of the role
+func newSTSServer(t *testing.T, action string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, action, r.FormValue("Action"))
+		if action == "AssumeRole" {
+			assert.Contains(t, r.Header.Get("Authorization"), "Credential=AKIDEXAMPLE/")
+			assert.Contains(t, r.Header.Get("Authorization"), "/us-west-2/sts/aws4_request")
+		} else {
+			assert.Equal(t, "web-identity", r.FormValue("WebIdentityToken"))
+		}
+		_, _ = fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLE</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-session</SessionToken>
+      <Expiration>%[2]s</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`, action, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+}
+
+func TestAssumeRole(t *testing.T) {
+	server := newSTSServer(t, "AssumeRole")
+	defer server.Close()
+	signer, err := NewSigV4Signer(SigV4Config{
+		Region:          "us-west-2",
+		AccessKeyID:     testAWSCredentials.AccessKeyID,
+		SecretAccessKey: testAWSCredentials.SecretAccessKey,
+		RoleARN:         "arn:aws:iam::123456789012:role/prometurbo",
+		STSEndpoint:     server.URL,
+	})
+	assert.Nil(t, err)
+	// The role is assumed within the context of the query
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = signer.credentials.get(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	credentials, err := signer.credentials.get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "ASIAROLE", credentials.AccessKeyID)
+	assert.Equal(t, "role-session", credentials.SessionToken)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/prometurbo", signer.identity)
+}
+
+func TestAssumeRoleWithWebIdentity(t *testing.T) {
+	server := newSTSServer(t, "AssumeRoleWithWebIdentity")
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("web-identity\n"), 0600))
+	t.Setenv(envAWSAccessKeyID, "")
+	t.Setenv(envAWSWebIdentityTokenFile, tokenFile)
+	t.Setenv(envAWSRoleARN, "arn:aws:iam::123456789012:role/eks-prometurbo")
+	signer, err := NewSigV4Signer(SigV4Config{Region: "us-west-2", STSEndpoint: server.URL})
+	assert.Nil(t, err)
+	credentials, err := signer.credentials.get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "ASIAROLE", credentials.AccessKeyID)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/eks-prometurbo", signer.identity)
+
+	t.Setenv(envAWSWebIdentityTokenFile, "")
+	_, err = NewSigV4Signer(SigV4Config{Region: "us-west-2"})
+	assert.NotNil(t, err)
+	_, err = NewSigV4Signer(SigV4Config{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"})
+	assert.NotNil(t, err)
+}
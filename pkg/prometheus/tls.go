@@ -0,0 +1,56 @@
+package prometheus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// TLSOptions are the TLS settings of the connections to a Prometheus server
+type TLSOptions struct {
+	// PEM encoded CA certificates to verify the server certificate with; the system CAs are used if empty
+	CA []byte
+	// PEM encoded client certificate and key presented to servers requiring mutual TLS
+	Cert []byte
+	Key  []byte
+	// Name to verify the server certificate against, instead of the host of the server address
+	ServerName string
+	// Skip the verification of the server certificate, which must be explicitly requested
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig builds the TLS configuration of the connections to a server from the TLS options
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if len(options.CA) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(options.CA) {
+			return nil, fmt.Errorf("no valid PEM certificate found in the CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(options.Cert) > 0 || len(options.Key) > 0 {
+		cert, err := tls.X509KeyPair(options.Cert, options.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newTransport creates the transport of a client. Each client has its own transport so that the TLS
+// configuration is not shared with the clients of the other servers.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 5,
+		DisableKeepAlives:   false,
+		IdleConnTimeout:     defaultTimeOut,
+		TLSClientConfig:     tlsConfig,
+	}
+}
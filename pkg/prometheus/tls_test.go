@@ -0,0 +1,51 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTLSServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+}
+
+func TestServerCertificateVerification(t *testing.T) {
+	server := newTLSServer()
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	// The certificate of the test server is not signed by a system CA
+	client := newTestRestClient(t, server.URL).WithRetry(0)
+	_, err := client.Query(context.Background(), "up")
+	assert.NotNil(t, err)
+
+	tlsConfig, err := NewTLSConfig(TLSOptions{CA: ca})
+	assert.Nil(t, err)
+	_, err = client.WithTLSConfig(tlsConfig).Query(context.Background(), "up")
+	assert.Nil(t, err)
+
+	// The certificate of the test server is issued for example.com
+	tlsConfig, err = NewTLSConfig(TLSOptions{CA: ca, ServerName: "prometheus.example.org"})
+	assert.Nil(t, err)
+	_, err = client.WithTLSConfig(tlsConfig).Query(context.Background(), "up")
+	assert.NotNil(t, err)
+
+	tlsConfig, err = NewTLSConfig(TLSOptions{InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	_, err = client.WithTLSConfig(tlsConfig).Query(context.Background(), "up")
+	assert.Nil(t, err)
+}
+
+func TestNewTLSConfigWithInvalidPEM(t *testing.T) {
+	_, err := NewTLSConfig(TLSOptions{CA: []byte("not a certificate")})
+	assert.NotNil(t, err)
+	_, err = NewTLSConfig(TLSOptions{Cert: []byte("not a certificate")})
+	assert.NotNil(t, err)
+}
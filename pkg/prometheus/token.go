@@ -0,0 +1,147 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TokenFileCheckInterval is how often a token file is read again to pick up a rotated token, e.g. a projected
+// service account token
+const TokenFileCheckInterval = 30 * time.Second
+
+// TokenSource provides the bearer token of the requests, so that a rotated token is used without restarting
+// the probe
+type TokenSource interface {
+	// Token returns the current token, which may be cached; the token is obtained within the context
+	Token(ctx context.Context) (string, error)
+	// Refresh reads the token again after the server rejected the given token, and returns true if the current
+	// token is different, so that the request is worth sending again
+	Refresh(ctx context.Context, rejected string) (bool, error)
+}
+
+// identifiedToken is a TokenSource that can identify its credentials without revealing them
+type identifiedToken interface {
+	// identity returns the same value for the sources of the same credentials
+	identity() string
+}
+
+// tokenIdentity identifies the credentials of the token source. The sources of unknown types are identified by
+// their address, or by the hash of their value.
+func tokenIdentity(token TokenSource) string {
+	if token == nil {
+		return ""
+	}
+	if t, ok := token.(identifiedToken); ok {
+		return t.identity()
+	}
+	if reflect.ValueOf(token).Kind() == reflect.Ptr {
+		return fmt.Sprintf("%T@%p", token, token)
+	}
+	return fmt.Sprintf("%T:%s", token, hashHex(fmt.Sprintf("%#v", token)))
+}
+
+// staticToken is a token that never changes
+type staticToken string
+
+// NewStaticTokenSource returns a TokenSource of a token that never changes
+func NewStaticTokenSource(token string) TokenSource {
+	return staticToken(token)
+}
+
+func (t staticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+func (t staticToken) Refresh(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+func (t staticToken) identity() string {
+	return "static:" + hashHex(string(t))
+}
+
+// cachedToken is a token read from its source again once it is older than the max age, or when it is rejected
+type cachedToken struct {
+	// Description of the source, for the logs; it also identifies the token, e.g. by its file or its Secret
+	name     string
+	read     func(ctx context.Context) (string, error)
+	maxAge   time.Duration
+	lock     sync.Mutex
+	token    string
+	readTime time.Time
+}
+
+// NewCachedTokenSource returns a TokenSource reading the token with the read function, caching it for maxAge.
+// The last token is kept if it cannot be read again. The name identifies the source, so the sources of different
+// tokens must have different names.
+func NewCachedTokenSource(name string, read func(ctx context.Context) (string, error),
+	maxAge time.Duration) TokenSource {
+	return &cachedToken{name: name, read: read, maxAge: maxAge}
+}
+
+// NewFileTokenSource returns a TokenSource reading the token from a file every TokenFileCheckInterval, or when
+// the token is rejected. The file is polled rather than watched, because the clients are recreated every time
+// the configuration changes and would leave their watchers behind.
+func NewFileTokenSource(path string) TokenSource {
+	return NewCachedTokenSource(path, func(context.Context) (string, error) {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %v", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}, TokenFileCheckInterval)
+}
+
+func (t *cachedToken) Token(ctx context.Context) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.readTime.IsZero() && time.Since(t.readTime) < t.maxAge {
+		return t.token, nil
+	}
+	token, err := t.read(ctx)
+	if err != nil {
+		if t.readTime.IsZero() {
+			return "", fmt.Errorf("failed to read token from %v: %v", t.name, err)
+		}
+		// Do not read again before the max age, to avoid failing every request on a transient error
+		glog.Warningf("Failed to read token from %v, keep using the last token: %v.", t.name, err)
+		t.readTime = time.Now()
+		return t.token, nil
+	}
+	t.update(token)
+	return t.token, nil
+}
+
+func (t *cachedToken) Refresh(ctx context.Context, rejected string) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != rejected {
+		// Already refreshed by another request
+		return true, nil
+	}
+	token, err := t.read(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to read token from %v: %v", t.name, err)
+	}
+	t.update(token)
+	return t.token != rejected, nil
+}
+
+func (t *cachedToken) identity() string {
+	return "cached:" + t.name
+}
+
+func (t *cachedToken) update(token string) {
+	if token != t.token && !t.readTime.IsZero() {
+		glog.V(2).Infof("Use rotated token (len=%d) from %v.", len(token), t.name)
+	}
+	t.token = token
+	t.readTime = time.Now()
+}
@@ -0,0 +1,92 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedTokenSource(t *testing.T) {
+	var reads atomic.Int32
+	token, readErr := "first", error(nil)
+	source := NewCachedTokenSource("test", func(context.Context) (string, error) {
+		reads.Add(1)
+		return token, readErr
+	}, time.Hour)
+
+	current, err := source.Token(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "first", current)
+	token = "second"
+	current, _ = source.Token(context.Background())
+	assert.Equal(t, "first", current)
+	assert.Equal(t, int32(1), reads.Load())
+
+	// A rejected token is read again, but only once for all the requests rejected with the same token
+	rotated, err := source.Refresh(context.Background(), "first")
+	assert.Nil(t, err)
+	assert.True(t, rotated)
+	rotated, _ = source.Refresh(context.Background(), "first")
+	assert.True(t, rotated)
+	assert.Equal(t, int32(2), reads.Load())
+	rotated, _ = source.Refresh(context.Background(), "second")
+	assert.False(t, rotated)
+
+	readErr = errors.New("unavailable")
+	_, err = source.Refresh(context.Background(), "second")
+	assert.NotNil(t, err)
+	current, _ = source.Token(context.Background())
+	assert.Equal(t, "second", current)
+}
+
+func TestFileTokenSource(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	_, err := NewFileTokenSource(tokenFile).Token(context.Background())
+	assert.NotNil(t, err)
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("first\n"), 0600))
+	source := NewFileTokenSource(tokenFile)
+	current, err := source.Token(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "first", current)
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("second\n"), 0600))
+	rotated, err := source.Refresh(context.Background(), current)
+	assert.Nil(t, err)
+	assert.True(t, rotated)
+	current, _ = source.Token(context.Background())
+	assert.Equal(t, "second", current)
+}
+
+func TestQueryWithRotatedToken(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer second" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("first"), 0600))
+	client := newTestRestClient(t, server.URL).WithTokenSource(NewFileTokenSource(tokenFile))
+
+	// The token has not been rotated, the query is not sent again
+	_, err := client.Query(context.Background(), "up")
+	assert.True(t, IsAuthError(err))
+	assert.Equal(t, int32(1), requests.Load())
+
+	requests.Store(0)
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("second"), 0600))
+	_, err = client.Query(context.Background(), "up")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+}
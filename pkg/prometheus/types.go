@@ -3,8 +3,13 @@ package prometheus
 import (
 	"bytes"
 	"fmt"
-	"github.com/prometheus/common/model"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
 )
 
 // RawMetric the raw metric from Prometheus: its labels and a time/value pair
@@ -22,6 +27,7 @@ func (m RawMetric) Parse() (MetricData, error) {
 	if math.IsNaN(metricData.Value) {
 		return nil, fmt.Errorf("failed to convert value: NaN")
 	}
+	metricData.Timestamp = m.Value.Timestamp.Time()
 	return metricData, nil
 }
 
@@ -35,6 +41,9 @@ type BasicMetricData struct {
 	Labels map[string]string
 	Value  float64
 	ID     string
+	// Timestamp of the sample. Prometheus returns the evaluation time of the query for an instant vector,
+	// but some compatible servers return the time the sample was scraped.
+	Timestamp time.Time
 }
 
 func NewBasicMetricData() *BasicMetricData {
@@ -56,6 +65,7 @@ func (d *BasicMetricData) Parse(m *RawMetric) error {
 	if math.IsNaN(d.Value) {
 		return fmt.Errorf("failed to convert value: NaN")
 	}
+	d.Timestamp = m.Value.Timestamp.Time()
 
 	return nil
 }
@@ -69,3 +79,130 @@ func (d *BasicMetricData) String() string {
 	}
 	return buffer.String()
 }
+
+// RawScalar the raw scalar from Prometheus: a time/value pair without labels
+type RawScalar model.Scalar
+
+func (m RawScalar) Parse() (MetricData, error) {
+	value := float64(m.Value)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("failed to convert value: %v", value)
+	}
+	return &ScalarMetricData{Value: value}, nil
+}
+
+// RawString the raw string from Prometheus: a time/value pair without labels, where the value is a string
+type RawString model.String
+
+func (m RawString) Parse() (MetricData, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(m.Value), 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert string %q: %v", m.Value, err)
+	}
+	return RawScalar{Value: model.SampleValue(value)}.Parse()
+}
+
+// ScalarMetricData holds the value of a scalar or string result, which does not belong to any series, and
+// implements MetricData
+type ScalarMetricData struct {
+	Value float64
+}
+
+func (d *ScalarMetricData) GetValue() float64 {
+	return d.Value
+}
+
+func (d *ScalarMetricData) String() string {
+	return fmt.Sprintf("value=%.6f\n", d.Value)
+}
+
+// RawRangeMetric the raw metric from a Prometheus range query: its labels and a list of time/value pairs
+type RawRangeMetric struct {
+	Labels map[string]string  `json:"metric"`
+	Values []model.SamplePair `json:"values"`
+}
+
+func (m RawRangeMetric) Parse() (MetricData, error) {
+	metricData := NewRangeMetricData()
+	for k, v := range m.Labels {
+		metricData.Labels[k] = v
+	}
+	for _, sample := range m.Values {
+		value := float64(sample.Value)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		metricData.Values = append(metricData.Values, value)
+		metricData.Timestamp = sample.Timestamp.Time()
+	}
+	if len(metricData.Values) == 0 {
+		return nil, fmt.Errorf("no valid sample value in the range")
+	}
+	return metricData, nil
+}
+
+// RangeMetricData holds the sample values of a series over a time range, and implements MetricData
+type RangeMetricData struct {
+	Labels map[string]string
+	Values []float64
+	// Timestamp of the last sample value
+	Timestamp time.Time
+}
+
+func NewRangeMetricData() *RangeMetricData {
+	return &RangeMetricData{
+		Labels: make(map[string]string),
+	}
+}
+
+// GetValue returns the average of the sample values
+func (d *RangeMetricData) GetValue() float64 {
+	return d.Average()
+}
+
+func (d *RangeMetricData) Average() float64 {
+	if len(d.Values) == 0 {
+		return math.NaN()
+	}
+	return d.Sum() / float64(len(d.Values))
+}
+
+func (d *RangeMetricData) Sum() float64 {
+	sum := 0.0
+	for _, v := range d.Values {
+		sum += v
+	}
+	return sum
+}
+
+func (d *RangeMetricData) Min() float64 {
+	return d.Percentile(0)
+}
+
+func (d *RangeMetricData) Max() float64 {
+	return d.Percentile(100)
+}
+
+// Percentile returns the p-th percentile (0 <= p <= 100) of the sample values, linearly interpolated
+// between the closest ranks
+func (d *RangeMetricData) Percentile(p float64) float64 {
+	if len(d.Values) == 0 || p < 0 || p > 100 {
+		return math.NaN()
+	}
+	values := append([]float64(nil), d.Values...)
+	sort.Float64s(values)
+	rank := p / 100 * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return values[lower] + (rank-float64(lower))*(values[upper]-values[lower])
+}
+
+func (d *RangeMetricData) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("values=%v\n", d.Values))
+	for k, v := range d.Labels {
+		buffer.WriteString(fmt.Sprintf("\t%v=%v\n", k, v))
+	}
+	return buffer.String()
+}
@@ -0,0 +1,19 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeMetricDataStatistics(t *testing.T) {
+	d := &RangeMetricData{Values: []float64{40, 10, 30, 20}}
+	assert.Equal(t, 25.0, d.Average())
+	assert.Equal(t, 10.0, d.Min())
+	assert.Equal(t, 40.0, d.Max())
+	assert.Equal(t, 25.0, d.Percentile(50))
+	assert.InDelta(t, 39.7, d.Percentile(99), 1e-9)
+	assert.True(t, math.IsNaN(d.Percentile(101)))
+	assert.True(t, math.IsNaN((&RangeMetricData{}).Average()))
+}
@@ -32,10 +32,19 @@ func entityDefFromConfigMap(entityConfig config.EntityConfig) (*provider.EntityD
 	if err != nil {
 		return nil, fmt.Errorf("failed to create attributeDefs for EntityDef type %v: %v", entityConfig.Type, err)
 	}
+	var enrichments []*provider.EnrichDef
+	for _, enrichConfig := range entityConfig.EnrichConfigs {
+		enrichment, err := provider.NewEnrichDef(enrichConfig.Query, enrichConfig.On, enrichConfig.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create enrichDefs for EntityDef type %v: %v", entityConfig.Type, err)
+		}
+		enrichments = append(enrichments, enrichment)
+	}
 	return &provider.EntityDef{
 		EType:         entityConfig.Type,
 		HostedOnVM:    entityConfig.HostedOnVM,
 		MetricDefs:    metrics,
 		AttributeDefs: attributes,
+		Enrichments:   enrichments,
 	}, nil
 }
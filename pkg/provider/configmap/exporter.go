@@ -15,12 +15,17 @@ func exporterDefFromConfigMap(exporterConfig config.ExporterConfig) (*exporterDe
 	if len(exporterConfig.EntityConfigs) == 0 {
 		return nil, fmt.Errorf("no entityDefs defined")
 	}
+	maxSampleAge, err := parseMaxSampleAge(exporterConfig.MaxSampleAge)
+	if err != nil {
+		return nil, err
+	}
 	var entities []*provider.EntityDef
 	for _, entityConfig := range exporterConfig.EntityConfigs {
 		entity, err := entityDefFromConfigMap(entityConfig)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create entityDefs: %v", err)
 		}
+		entity.MaxSampleAge = maxSampleAge
 		entities = append(entities, entity)
 	}
 	return &exporterDef{
@@ -2,10 +2,14 @@ package configmap
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
 
 	"github.ibm.com/turbonomic/prometurbo/pkg/config"
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
 	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
 )
 
@@ -24,7 +28,58 @@ func metricDefFromConfigMap(metricConfig config.MetricConfig) (*provider.MetricD
 		Queries: make(map[string]string),
 	}
 	for k, v := range metricConfig.Queries {
+		if _, supported := provider.MetricKindToDIFMetricValKind[k]; !supported {
+			return nil, fmt.Errorf("unsupported query type %q", k)
+		}
 		metricDef.Queries[k] = v
 	}
+	if metricConfig.Aggregation != "" && !provider.Aggregations[metricConfig.Aggregation] {
+		return nil, fmt.Errorf("unsupported aggregation %q", metricConfig.Aggregation)
+	}
+	metricDef.Aggregation = metricConfig.Aggregation
+	if metricConfig.SeriesAggregation != "" && !provider.Aggregations[metricConfig.SeriesAggregation] {
+		return nil, fmt.Errorf("unsupported series aggregation %q", metricConfig.SeriesAggregation)
+	}
+	metricDef.SeriesAggregation = metricConfig.SeriesAggregation
+	metricDef.Key = strings.TrimSpace(metricConfig.Key)
+	conversion, err := provider.NewConversion(metricConfig.Type, metricConfig.Unit, metricConfig.Conversion,
+		metricConfig.Scale, metricConfig.Offset)
+	if err != nil {
+		return nil, err
+	}
+	metricDef.Conversion = conversion
+	if metricConfig.Range != nil {
+		rangeDef, err := rangeDefFromConfigMap(*metricConfig.Range)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range: %v", err)
+		}
+		if _, exist := metricConfig.Queries[provider.Peak]; exist {
+			return nil, fmt.Errorf("query for peak value cannot be used with range, " +
+				"the peak value is computed from the range")
+		}
+		metricDef.Range = rangeDef
+	}
 	return &metricDef, nil
 }
+
+func rangeDefFromConfigMap(rangeConfig config.RangeConfig) (*provider.RangeDef, error) {
+	window, err := model.ParseDuration(rangeConfig.Window)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse window %q: %v", rangeConfig.Window, err)
+	}
+	step, err := model.ParseDuration(rangeConfig.Step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse step %q: %v", rangeConfig.Step, err)
+	}
+	if err := prometheus.ValidateRange(time.Duration(window), time.Duration(step)); err != nil {
+		return nil, err
+	}
+	if rangeConfig.Percentile < 0 || rangeConfig.Percentile > 100 {
+		return nil, fmt.Errorf("percentile %v is not between 0 and 100", rangeConfig.Percentile)
+	}
+	return &provider.RangeDef{
+		Window:     time.Duration(window),
+		Step:       time.Duration(step),
+		Percentile: rangeConfig.Percentile,
+	}, nil
+}
@@ -25,9 +25,13 @@ func (p *MetricProviderImpl) GetTasks() (tasks []*provider.Task) {
 			if !found {
 				continue
 			}
-			for _, entityDef := range expDef.entityDefs {
-				clusterId := v1alpha1.ClusterIdentifier{ID: svrDef.clusterId}
-				tasks = append(tasks, provider.NewTask(svrDef.promClient, entityDef).WithClusterId(&clusterId))
+			for _, tenant := range svrDef.tenants {
+				for _, entityDef := range expDef.entityDefs {
+					clusterId := v1alpha1.ClusterIdentifier{ID: tenant.clusterId}
+					tasks = append(tasks, provider.NewTask(tenant.promClient, entityDef).
+						WithClusterId(&clusterId).
+						WithMaxSampleAge(svrDef.maxSampleAge))
+				}
 			}
 		}
 	}
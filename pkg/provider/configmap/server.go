@@ -2,6 +2,11 @@ package configmap
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
 
 	"github.ibm.com/turbonomic/prometurbo/pkg/config"
 	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
@@ -13,6 +18,16 @@ type serverDef struct {
 	password   string
 	clusterId  string
 	exporters  []string
+	// Samples older than this age are dropped; no limit if 0
+	maxSampleAge time.Duration
+	// Tenants of a multi-tenant backend, or the server itself with its cluster ID if there is no tenant
+	tenants []*tenantDef
+}
+
+// tenantDef is a tenant of a multi-tenant backend, queried with the tenant headers
+type tenantDef struct {
+	promClient *prometheus.RestClient
+	clusterId  string
 }
 
 func serverDefFromConfigMap(serverConfig config.ServerConfig) (*serverDef, error) {
@@ -22,19 +37,224 @@ func serverDefFromConfigMap(serverConfig config.ServerConfig) (*serverDef, error
 	if len(serverConfig.Exporters) == 0 {
 		return nil, fmt.Errorf("missing exporters")
 	}
-	promClient, err := prometheus.NewRestClient(serverConfig.URL, serverConfig.BearerToken)
+	token, err := tokenSource(serverConfig)
+	if err != nil {
+		return nil, err
+	}
+	promClient, err := prometheus.NewRestClientWithTokenSource(serverConfig.URL, token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create prometheus client from %v: %v",
 			serverConfig.URL, err)
 	}
 	promClient.SetUser(serverConfig.Username, serverConfig.Password)
+	if err := setResilience(promClient, serverConfig); err != nil {
+		return nil, err
+	}
+	if err := setTLS(promClient, serverConfig.TLS); err != nil {
+		return nil, err
+	}
+	if err := setSigV4(promClient, serverConfig); err != nil {
+		return nil, err
+	}
+	headers, err := readHeaders(serverConfig.Headers, serverConfig.HeaderFiles)
+	if err != nil {
+		return nil, err
+	}
+	promClient.WithHeaders(headers)
+	maxSampleAge, err := parseMaxSampleAge(serverConfig.MaxSampleAge)
+	if err != nil {
+		return nil, err
+	}
+	tenants := []*tenantDef{{promClient: promClient, clusterId: serverConfig.ClusterId}}
+	if len(serverConfig.Tenants) > 0 {
+		tenants = nil
+		for _, tenantConfig := range serverConfig.Tenants {
+			if tenantConfig.ClusterId == "" {
+				return nil, fmt.Errorf("missing clusterId of tenant")
+			}
+			tenantHeaders, err := readHeaders(tenantConfig.Headers, tenantConfig.HeaderFiles)
+			if err != nil {
+				return nil, fmt.Errorf("invalid headers of tenant %v: %v", tenantConfig.ClusterId, err)
+			}
+			tenants = append(tenants, &tenantDef{
+				promClient: promClient.ForTenant(tenantHeaders),
+				clusterId:  tenantConfig.ClusterId,
+			})
+		}
+	}
 	return &serverDef{
-		promClient: promClient,
-		clusterId:  serverConfig.ClusterId,
-		exporters:  serverConfig.Exporters,
+		promClient:   promClient,
+		clusterId:    serverConfig.ClusterId,
+		exporters:    serverConfig.Exporters,
+		maxSampleAge: maxSampleAge,
+		tenants:      tenants,
 	}, nil
 }
 
+// readHeaders merges the static headers with the headers whose values are read from files
+func readHeaders(headers, headerFiles map[string]string) (map[string]string, error) {
+	merged := make(map[string]string, len(headers)+len(headerFiles))
+	for name, value := range headers {
+		merged[name] = value
+	}
+	for name, file := range headerFiles {
+		value, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the value of header %v: %v", name, err)
+		}
+		merged[name] = strings.TrimSpace(string(value))
+	}
+	return merged, nil
+}
+
+// setResilience sets the timeout, the retries, the query limits and the circuit breaker of the prometheus client
+func setResilience(promClient *prometheus.RestClient, serverConfig config.ServerConfig) error {
+	if serverConfig.Timeout != "" {
+		timeout, err := time.ParseDuration(serverConfig.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", serverConfig.Timeout)
+		}
+		promClient.WithTimeout(timeout)
+	}
+	if serverConfig.MaxRetries != nil {
+		if *serverConfig.MaxRetries < 0 {
+			return fmt.Errorf("invalid maxRetries %d", *serverConfig.MaxRetries)
+		}
+		promClient.WithRetry(*serverConfig.MaxRetries)
+	}
+	if breaker := serverConfig.CircuitBreaker; breaker != nil {
+		var cooldown time.Duration
+		if breaker.Cooldown != "" {
+			var err error
+			if cooldown, err = time.ParseDuration(breaker.Cooldown); err != nil || cooldown <= 0 {
+				return fmt.Errorf("invalid circuit breaker cooldown %q", breaker.Cooldown)
+			}
+		}
+		failureThreshold := prometheus.DefaultFailureThreshold
+		if breaker.FailureThreshold != nil {
+			if failureThreshold = *breaker.FailureThreshold; failureThreshold < 0 {
+				return fmt.Errorf("invalid circuit breaker failureThreshold %d", failureThreshold)
+			}
+		}
+		promClient.WithCircuitBreaker(failureThreshold, cooldown)
+	}
+	if serverConfig.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("invalid maxConcurrentQueries %d", serverConfig.MaxConcurrentQueries)
+	}
+	if serverConfig.QueriesPerSecond < 0 {
+		return fmt.Errorf("invalid queriesPerSecond %v", serverConfig.QueriesPerSecond)
+	}
+	promClient.WithRateLimit(serverConfig.MaxConcurrentQueries, serverConfig.QueriesPerSecond)
+	return nil
+}
+
+// tokenSource returns the source of the bearer token of the server, or nil if the server requires no token
+func tokenSource(serverConfig config.ServerConfig) (prometheus.TokenSource, error) {
+	oauth2Config := serverConfig.OAuth2
+	switch {
+	case oauth2Config != nil:
+		if serverConfig.BearerToken != "" || serverConfig.BearerTokenFile != "" {
+			return nil, fmt.Errorf("oauth2 cannot be combined with a bearerToken or a bearerTokenFile")
+		}
+		clientSecret := oauth2Config.ClientSecret
+		if oauth2Config.ClientSecretFile != "" {
+			value, err := os.ReadFile(oauth2Config.ClientSecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the OAuth2 client secret file: %v", err)
+			}
+			clientSecret = strings.TrimSpace(string(value))
+		}
+		return prometheus.NewOAuth2TokenSource(prometheus.OAuth2Config{
+			TokenURL:     oauth2Config.TokenURL,
+			ClientID:     oauth2Config.ClientID,
+			ClientSecret: clientSecret,
+			Scopes:       oauth2Config.Scopes,
+		})
+	case serverConfig.BearerTokenFile != "":
+		return prometheus.NewFileTokenSource(serverConfig.BearerTokenFile), nil
+	case serverConfig.BearerToken != "":
+		return prometheus.NewStaticTokenSource(serverConfig.BearerToken), nil
+	}
+	return nil, nil
+}
+
+// setSigV4 signs the requests of the prometheus client with AWS Signature Version 4
+func setSigV4(promClient *prometheus.RestClient, serverConfig config.ServerConfig) error {
+	sigV4Config := serverConfig.SigV4
+	if sigV4Config == nil {
+		return nil
+	}
+	if serverConfig.BearerToken != "" || serverConfig.BearerTokenFile != "" || serverConfig.OAuth2 != nil ||
+		serverConfig.Username != "" {
+		return fmt.Errorf("sigv4 cannot be combined with another authentication")
+	}
+	secretAccessKey := sigV4Config.SecretAccessKey
+	if sigV4Config.SecretAccessKeyFile != "" {
+		value, err := os.ReadFile(sigV4Config.SecretAccessKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the secret access key file: %v", err)
+		}
+		secretAccessKey = strings.TrimSpace(string(value))
+	}
+	signer, err := prometheus.NewSigV4Signer(prometheus.SigV4Config{
+		Region:          sigV4Config.Region,
+		AccessKeyID:     sigV4Config.AccessKeyID,
+		SecretAccessKey: secretAccessKey,
+		RoleARN:         sigV4Config.RoleARN,
+	})
+	if err != nil {
+		return err
+	}
+	promClient.WithSigV4Signer(signer)
+	return nil
+}
+
+// setTLS sets the TLS configuration of the prometheus client, reading the CA bundle and the client certificate
+// from their files
+func setTLS(promClient *prometheus.RestClient, tlsConfig *config.TLSConfig) error {
+	if tlsConfig == nil {
+		return nil
+	}
+	options := prometheus.TLSOptions{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+	var err error
+	if tlsConfig.CAFile != "" {
+		if options.CA, err = os.ReadFile(tlsConfig.CAFile); err != nil {
+			return fmt.Errorf("failed to read the CA file: %v", err)
+		}
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return fmt.Errorf("both the certFile and the keyFile are required for a client certificate")
+	}
+	if tlsConfig.CertFile != "" {
+		if options.Cert, err = os.ReadFile(tlsConfig.CertFile); err != nil {
+			return fmt.Errorf("failed to read the client certificate file: %v", err)
+		}
+		if options.Key, err = os.ReadFile(tlsConfig.KeyFile); err != nil {
+			return fmt.Errorf("failed to read the client key file: %v", err)
+		}
+	}
+	clientTLSConfig, err := prometheus.NewTLSConfig(options)
+	if err != nil {
+		return err
+	}
+	promClient.WithTLSConfig(clientTLSConfig)
+	return nil
+}
+
+func parseMaxSampleAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxSampleAge, err := model.ParseDuration(value)
+	if err != nil || maxSampleAge <= 0 {
+		return 0, fmt.Errorf("invalid maxSampleAge %q", value)
+	}
+	return time.Duration(maxSampleAge), nil
+}
+
 func serversFromConfigMap(cfg *config.MetricsDiscoveryConfig) (map[string]*serverDef, error) {
 	servers := make(map[string]*serverDef)
 	for name, serverConfig := range cfg.ServerConfigs {
@@ -0,0 +1,248 @@
+package customresource
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
+)
+
+// The PrometheusServerConfig and PrometheusQueryMapping resources do not have fields for the settings below,
+// so they are read from the annotations of the resources
+const (
+	annotationPrefix = "prometurbo.turbonomic.io/"
+	// Timeout of each attempt of a query, e.g. 30s
+	timeoutAnnotation = annotationPrefix + "timeout"
+	// Number of times a query is retried after a connection error, a timeout, a 5xx or a 429 status
+	maxRetriesAnnotation = annotationPrefix + "max-retries"
+	// Consecutive failures to open the circuit breaker, 0 to disable it
+	failureThresholdAnnotation = annotationPrefix + "circuit-breaker-failure-threshold"
+	// Time before querying the server again after the circuit breaker is opened, e.g. 2m
+	cooldownAnnotation = annotationPrefix + "circuit-breaker-cooldown"
+	// Limits of the queries sent to the server by all tasks
+	maxConcurrentQueriesAnnotation = annotationPrefix + "max-concurrent-queries"
+	queriesPerSecondAnnotation     = annotationPrefix + "queries-per-second"
+	// TLS settings of the connections to the server. The CA Secret holds the CA bundle in its ca.crt key, the
+	// client certificate Secret is a kubernetes.io/tls Secret with the tls.crt and tls.key keys. Both Secrets
+	// must be in the namespace of the PrometheusServerConfig resource.
+	tlsCASecretAnnotation         = annotationPrefix + "tls-ca-secret"
+	tlsClientCertSecretAnnotation = annotationPrefix + "tls-client-cert-secret"
+	tlsServerNameAnnotation       = annotationPrefix + "tls-server-name"
+	// Skip the verification of the server certificate, only if set to "true"
+	tlsInsecureSkipVerifyAnnotation = annotationPrefix + "tls-insecure-skip-verify"
+	// Additional headers of the requests as a JSON object, e.g. '{"X-Scope-OrgID": "team-a"}'
+	headersAnnotation = annotationPrefix + "headers"
+	// Additional headers whose values are read from Secrets in the namespace of the PrometheusServerConfig
+	// resource, as a JSON object of "<secret name>/<key>", e.g. '{"X-Api-Key": "prometheus-api/key"}'
+	headerSecretsAnnotation = annotationPrefix + "header-secrets"
+	// Tenants of a multi-tenant backend as a JSON object of the headers of each tenant by the ID of the cluster
+	// that the tenant is discovered as, e.g. '{"prod": {"X-Scope-OrgID": "prod"}, "dev": {"X-Scope-OrgID": "dev"}}'.
+	// Each ID must be the ID of the identifier of one of the clusters of the PrometheusServerConfig resource.
+	tenantsAnnotation = annotationPrefix + "tenants"
+	// OAuth2 client credentials that the bearer token is obtained with, instead of the bearer token of the resource.
+	// The client secret is read from a Secret in the namespace of the PrometheusServerConfig resource as
+	// "<secret name>/<key>", and the scopes are separated by commas.
+	oauth2TokenURLAnnotation     = annotationPrefix + "oauth2-token-url"
+	oauth2ClientIDAnnotation     = annotationPrefix + "oauth2-client-id"
+	oauth2ClientSecretAnnotation = annotationPrefix + "oauth2-client-secret"
+	oauth2ScopesAnnotation       = annotationPrefix + "oauth2-scopes"
+	// AWS Signature Version 4 signing of the requests, e.g. for Amazon Managed Service for Prometheus, instead of
+	// the bearer token of the resource. The credentials Secret in the namespace of the PrometheusServerConfig
+	// resource holds the aws_access_key_id and the aws_secret_access_key keys; without it, the credentials of the
+	// environment or the web identity of the IAM role of the service account are used. The role is optional.
+	sigV4RegionAnnotation            = annotationPrefix + "sigv4-region"
+	sigV4RoleARNAnnotation           = annotationPrefix + "sigv4-role-arn"
+	sigV4CredentialsSecretAnnotation = annotationPrefix + "sigv4-credentials-secret"
+	// Aggregation of the series that map to the same entity for all metrics of a PrometheusQueryMapping,
+	// which can be overridden for a metric by suffixing the annotation with ".<entity type>.<metric type>",
+	// e.g. prometurbo.turbonomic.io/series-aggregation.application.responseTime
+	seriesAggregationAnnotation = annotationPrefix + "series-aggregation"
+	// Samples older than this age are dropped, e.g. 5m. The annotation of a PrometheusQueryMapping overrides
+	// the one of the PrometheusServerConfig. The age is only known for the queries that are a vector selector,
+	// e.g. up{job="prometheus"}; the samples computed by functions, operators or aggregations, e.g. rate() or
+	// sum(), are evaluated at the time of the query and are never dropped.
+	maxSampleAgeAnnotation = annotationPrefix + "max-sample-age"
+	// The annotations below are suffixed with ".<entity type>.<metric type>" for a metric, e.g.
+	// prometurbo.turbonomic.io/key.application.kpi: "${queue}"
+	// Commodity key of a metric
+	keyAnnotation = annotationPrefix + "key"
+	// Unit of the metric values after conversion
+	unitAnnotation = annotationPrefix + "unit"
+	// Named conversion of the metric values, e.g. bytesToMB
+	conversionAnnotation = annotationPrefix + "conversion"
+	// Scale and offset of the metric values, converted as value*scale + offset
+	scaleAnnotation  = annotationPrefix + "scale"
+	offsetAnnotation = annotationPrefix + "offset"
+	// Info queries whose series labels are joined onto the series of the metric queries of an entity, as a JSON
+	// list suffixed with ".<entity type>", e.g. prometurbo.turbonomic.io/enrich.application:
+	// '[{"query": "kube_pod_info", "on": ["namespace", "pod"], "labels": ["pod_ip"]}]'
+	enrichAnnotation = annotationPrefix + "enrich"
+)
+
+// setResilience sets the timeout, the retries, the query limits and the circuit breaker of the prometheus client
+// from the annotations of the PrometheusServerConfig resource
+func setResilience(promClient *prometheus.RestClient, annotations map[string]string) error {
+	if value, found := annotations[timeoutAnnotation]; found {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid annotation %v: %q", timeoutAnnotation, value)
+		}
+		promClient.WithTimeout(timeout)
+	}
+	if value, found := annotations[maxRetriesAnnotation]; found {
+		maxRetries, err := strconv.Atoi(value)
+		if err != nil || maxRetries < 0 {
+			return fmt.Errorf("invalid annotation %v: %q", maxRetriesAnnotation, value)
+		}
+		promClient.WithRetry(maxRetries)
+	}
+	var maxConcurrentQueries int
+	if value, found := annotations[maxConcurrentQueriesAnnotation]; found {
+		var err error
+		if maxConcurrentQueries, err = strconv.Atoi(value); err != nil || maxConcurrentQueries < 0 {
+			return fmt.Errorf("invalid annotation %v: %q", maxConcurrentQueriesAnnotation, value)
+		}
+	}
+	var queriesPerSecond float64
+	if value, found := annotations[queriesPerSecondAnnotation]; found {
+		var err error
+		if queriesPerSecond, err = strconv.ParseFloat(value, 64); err != nil || queriesPerSecond < 0 {
+			return fmt.Errorf("invalid annotation %v: %q", queriesPerSecondAnnotation, value)
+		}
+	}
+	promClient.WithRateLimit(maxConcurrentQueries, queriesPerSecond)
+	thresholdValue, hasThreshold := annotations[failureThresholdAnnotation]
+	cooldownValue, hasCooldown := annotations[cooldownAnnotation]
+	if !hasThreshold && !hasCooldown {
+		return nil
+	}
+	failureThreshold := prometheus.DefaultFailureThreshold
+	if hasThreshold {
+		var err error
+		if failureThreshold, err = strconv.Atoi(thresholdValue); err != nil || failureThreshold < 0 {
+			return fmt.Errorf("invalid annotation %v: %q", failureThresholdAnnotation, thresholdValue)
+		}
+	}
+	var cooldown time.Duration
+	if hasCooldown {
+		var err error
+		if cooldown, err = time.ParseDuration(cooldownValue); err != nil || cooldown <= 0 {
+			return fmt.Errorf("invalid annotation %v: %q", cooldownAnnotation, cooldownValue)
+		}
+	}
+	promClient.WithCircuitBreaker(failureThreshold, cooldown)
+	return nil
+}
+
+// maxSampleAge returns the maximum age of the samples from the annotations of a resource, or 0 if there is no limit
+func maxSampleAge(annotations map[string]string) (time.Duration, error) {
+	value, found := annotations[maxSampleAgeAnnotation]
+	if !found {
+		return 0, nil
+	}
+	maxSampleAge, err := model.ParseDuration(value)
+	if err != nil || maxSampleAge <= 0 {
+		return 0, fmt.Errorf("invalid annotation %v: %q", maxSampleAgeAnnotation, value)
+	}
+	return time.Duration(maxSampleAge), nil
+}
+
+// setMetricAnnotations sets the settings of a metric of an entity from the annotations of the
+// PrometheusQueryMapping resource
+func setMetricAnnotations(metricDef *provider.MetricDef, annotations map[string]string, entityType string) error {
+	var err error
+	if metricDef.SeriesAggregation, err = seriesAggregation(annotations, entityType, metricDef.MType); err != nil {
+		return err
+	}
+	metricDef.Key = metricKey(annotations, entityType, metricDef.MType)
+	if metricDef.Conversion, err = metricConversion(annotations, entityType, metricDef.MType); err != nil {
+		return err
+	}
+	return nil
+}
+
+// seriesAggregation returns the series aggregation of a metric of an entity from the annotations of the
+// PrometheusQueryMapping resource
+func seriesAggregation(annotations map[string]string, entityType, metricType string) (string, error) {
+	annotation := seriesAggregationAnnotation + "." + entityType + "." + metricType
+	value, found := annotations[annotation]
+	if !found {
+		annotation = seriesAggregationAnnotation
+		value = annotations[annotation]
+	}
+	if value != "" && !provider.Aggregations[value] {
+		return "", fmt.Errorf("invalid annotation %v: %q", annotation, value)
+	}
+	return value, nil
+}
+
+// metricAnnotation returns the name and the value of the annotation for a metric of an entity
+func metricAnnotation(annotations map[string]string, prefix, entityType, metricType string) (string, string) {
+	annotation := prefix + "." + entityType + "." + metricType
+	return annotation, strings.TrimSpace(annotations[annotation])
+}
+
+// metricKey returns the key template of a metric of an entity from the annotations of the PrometheusQueryMapping
+// resource
+func metricKey(annotations map[string]string, entityType, metricType string) string {
+	_, key := metricAnnotation(annotations, keyAnnotation, entityType, metricType)
+	return key
+}
+
+// metricConversion returns the conversion of a metric of an entity from the annotations of the
+// PrometheusQueryMapping resource
+func metricConversion(annotations map[string]string, entityType, metricType string) (*provider.Conversion, error) {
+	_, unit := metricAnnotation(annotations, unitAnnotation, entityType, metricType)
+	_, name := metricAnnotation(annotations, conversionAnnotation, entityType, metricType)
+	var scale *float64
+	if annotation, value := metricAnnotation(annotations, scaleAnnotation, entityType, metricType); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %v: %q", annotation, value)
+		}
+		scale = &parsed
+	}
+	var offset float64
+	if annotation, value := metricAnnotation(annotations, offsetAnnotation, entityType, metricType); value != "" {
+		var err error
+		if offset, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("invalid annotation %v: %q", annotation, value)
+		}
+	}
+	return provider.NewConversion(metricType, unit, name, scale, offset)
+}
+
+// enrichConfig is the JSON format of an info query in the enrich annotation
+type enrichConfig struct {
+	Query  string   `json:"query"`
+	On     []string `json:"on"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// enrichDefs returns the info queries of an entity from the annotations of the PrometheusQueryMapping resource
+func enrichDefs(annotations map[string]string, entityType string) ([]*provider.EnrichDef, error) {
+	annotation := enrichAnnotation + "." + entityType
+	value := strings.TrimSpace(annotations[annotation])
+	if value == "" {
+		return nil, nil
+	}
+	var configs []enrichConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("invalid annotation %v: %v", annotation, err)
+	}
+	var defs []*provider.EnrichDef
+	for _, config := range configs {
+		def, err := provider.NewEnrichDef(config.Query, config.On, config.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %v: %v", annotation, err)
+		}
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
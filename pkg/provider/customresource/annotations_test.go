@@ -0,0 +1,182 @@
+package customresource
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
+)
+
+func TestSetResilience(t *testing.T) {
+	promClient, err := prometheus.NewRestClient("http://prometheus:9090", "")
+	assert.Nil(t, err)
+	assert.Nil(t, setResilience(promClient, nil))
+	assert.Nil(t, setResilience(promClient, map[string]string{
+		timeoutAnnotation:              "30s",
+		maxRetriesAnnotation:           "0",
+		failureThresholdAnnotation:     "0",
+		cooldownAnnotation:             "5m",
+		maxConcurrentQueriesAnnotation: "2",
+		queriesPerSecondAnnotation:     "0.5",
+	}))
+	for annotation, value := range map[string]string{
+		timeoutAnnotation:              "30",
+		maxRetriesAnnotation:           "-1",
+		failureThresholdAnnotation:     "many",
+		cooldownAnnotation:             "0s",
+		maxConcurrentQueriesAnnotation: "-1",
+		queriesPerSecondAnnotation:     "fast",
+	} {
+		assert.NotNil(t, setResilience(promClient, map[string]string{annotation: value}), annotation)
+	}
+}
+
+func TestSeriesAggregation(t *testing.T) {
+	annotations := map[string]string{
+		seriesAggregationAnnotation:                               "sum",
+		seriesAggregationAnnotation + ".application.responseTime": "avg",
+		seriesAggregationAnnotation + ".application.cpu":          "median",
+	}
+	aggregation, err := seriesAggregation(annotations, "application", "transaction")
+	assert.Nil(t, err)
+	assert.Equal(t, "sum", aggregation)
+	aggregation, err = seriesAggregation(annotations, "application", "responseTime")
+	assert.Nil(t, err)
+	assert.Equal(t, "avg", aggregation)
+	_, err = seriesAggregation(annotations, "application", "cpu")
+	assert.NotNil(t, err)
+	aggregation, err = seriesAggregation(nil, "application", "cpu")
+	assert.Nil(t, err)
+	assert.Equal(t, "", aggregation)
+}
+
+func TestEnrichDefs(t *testing.T) {
+	defs, err := enrichDefs(map[string]string{
+		enrichAnnotation + ".application": `[{"query":"kube_pod_info","on":["namespace","pod"],"labels":["pod_ip"]}]`,
+	}, "application")
+	assert.Nil(t, err)
+	assert.Equal(t, []*provider.EnrichDef{{
+		Query:  "kube_pod_info",
+		On:     []string{"namespace", "pod"},
+		Labels: []string{"pod_ip"},
+	}}, defs)
+	defs, err = enrichDefs(nil, "application")
+	assert.Nil(t, err)
+	assert.Nil(t, defs)
+	_, err = enrichDefs(map[string]string{enrichAnnotation + ".application": `[{"query":"kube_pod_info"}]`},
+		"application")
+	assert.NotNil(t, err)
+}
+
+func TestTLSSecretRefs(t *testing.T) {
+	serverConfig := &v1alpha1.PrometheusServerConfig{}
+	serverConfig.Namespace = "turbo"
+	serverConfig.Annotations = map[string]string{
+		tlsCASecretAnnotation:         "prometheus-ca",
+		tlsClientCertSecretAnnotation: "prometheus-client",
+	}
+	assert.Equal(t, []types.NamespacedName{
+		{Namespace: "turbo", Name: "prometheus-ca"},
+		{Namespace: "turbo", Name: "prometheus-client"},
+	}, secretRefs(serverConfig))
+	// An invalid annotation is reported before any Secret is read
+	serverConfig.Annotations = map[string]string{tlsInsecureSkipVerifyAnnotation: "maybe"}
+	_, err := serverTLSConfig(serverConfig, nil)
+	assert.NotNil(t, err)
+	tlsConfig, err := serverTLSConfig(&v1alpha1.PrometheusServerConfig{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+func TestHeaderSecretRefs(t *testing.T) {
+	serverConfig := &v1alpha1.PrometheusServerConfig{}
+	serverConfig.Namespace = "turbo"
+	serverConfig.Annotations = map[string]string{
+		headersAnnotation:       `{"X-Scope-OrgID": "team-a"}`,
+		headerSecretsAnnotation: `{"X-Api-Key": "prometheus-api/key", "X-Signature": "prometheus-signing/signature"}`,
+	}
+	assert.Equal(t, []types.NamespacedName{
+		{Namespace: "turbo", Name: "prometheus-api"},
+		{Namespace: "turbo", Name: "prometheus-signing"},
+	}, secretRefs(serverConfig))
+	serverConfig.Annotations[headerSecretsAnnotation] = `{"X-Api-Key": "prometheus-api"}`
+	_, err := headerSecretRefs(serverConfig.Annotations)
+	assert.NotNil(t, err)
+	assert.Empty(t, secretRefs(serverConfig))
+	// Only the static headers are read without a Secret
+	delete(serverConfig.Annotations, headerSecretsAnnotation)
+	headers, err := serverHeaders(serverConfig, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"X-Scope-OrgID": "team-a"}, headers)
+}
+
+func TestTenantClients(t *testing.T) {
+	promClient, err := prometheus.NewRestClient("http://prometheus:9090", "")
+	assert.Nil(t, err)
+	tenants, err := tenantHeaders(map[string]string{
+		tenantsAnnotation: `{"prod": {"X-Scope-OrgID": "prod"}, "staging": {"X-Scope-OrgID": "staging"}}`,
+	})
+	assert.Nil(t, err)
+	prod := &clusterConfig{clusterId: &v1alpha1.ClusterIdentifier{ID: "prod"}}
+	dev := &clusterConfig{clusterId: &v1alpha1.ClusterIdentifier{ID: "dev"}}
+	setTenantClients([]*clusterConfig{prod, dev}, promClient, tenants)
+	assert.NotSame(t, promClient, prod.promClient)
+	assert.Same(t, promClient, dev.promClient)
+
+	_, err = tenantHeaders(map[string]string{tenantsAnnotation: `["prod"]`})
+	assert.NotNil(t, err)
+}
+
+func TestOAuth2Annotations(t *testing.T) {
+	serverConfig := &v1alpha1.PrometheusServerConfig{}
+	serverConfig.Namespace = "turbo"
+	token, err := serverOAuth2Token(serverConfig, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, token)
+
+	serverConfig.Annotations = map[string]string{
+		oauth2TokenURLAnnotation:     "https://login.example.com/oauth2/token",
+		oauth2ClientIDAnnotation:     "prometurbo",
+		oauth2ClientSecretAnnotation: "prometurbo-oauth2/client-secret",
+		oauth2ScopesAnnotation:       "metrics.read, tenant",
+	}
+	assert.Equal(t, []types.NamespacedName{{Namespace: "turbo", Name: "prometurbo-oauth2"}},
+		secretRefs(serverConfig))
+	// The annotations are validated before the Secret is read
+	serverConfig.Annotations[oauth2ClientSecretAnnotation] = "prometurbo-oauth2"
+	_, err = serverOAuth2Token(serverConfig, nil)
+	assert.NotNil(t, err)
+	assert.Empty(t, secretRefs(serverConfig))
+	delete(serverConfig.Annotations, oauth2ClientSecretAnnotation)
+	token, err = serverOAuth2Token(serverConfig, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, token)
+	serverConfig.Annotations[oauth2TokenURLAnnotation] = ""
+	_, err = serverOAuth2Token(serverConfig, nil)
+	assert.NotNil(t, err)
+}
+
+func TestSigV4Annotations(t *testing.T) {
+	serverConfig := &v1alpha1.PrometheusServerConfig{}
+	serverConfig.Namespace = "turbo"
+	signer, err := serverSigV4Signer(serverConfig, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, signer)
+
+	serverConfig.Annotations = map[string]string{
+		sigV4RoleARNAnnotation:           "arn:aws:iam::123456789012:role/prometurbo",
+		sigV4CredentialsSecretAnnotation: "prometurbo-aws",
+	}
+	assert.Equal(t, []types.NamespacedName{{Namespace: "turbo", Name: "prometurbo-aws"}}, secretRefs(serverConfig))
+	// The annotations are validated before the Secret is read
+	_, err = serverSigV4Signer(serverConfig, nil)
+	assert.ErrorContains(t, err, sigV4RegionAnnotation)
+	serverConfig.Annotations[sigV4RegionAnnotation] = "us-west-2"
+	serverConfig.Annotations[oauth2TokenURLAnnotation] = "https://login.example.com/oauth2/token"
+	_, err = serverSigV4Signer(serverConfig, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,230 @@
+package customresource
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// configCache caches the server configurations converted from the custom resources. The configurations are
+// only rebuilt after a PrometheusQueryMapping, a PrometheusServerConfig or a Secret referenced by a
+// PrometheusServerConfig has changed, so that a discovery neither lists the custom resources nor rebuilds the
+// prometheus clients and the compiled attribute expressions when nothing has changed.
+// Only the metadata of the Secrets is watched, and only in the namespaces of the referenced Secrets.
+type configCache struct {
+	kubeClient    client.WithWatch
+	valid         atomic.Bool
+	lock          sync.Mutex
+	serverConfigs []*serverConfig
+	// Secrets referenced by the cached server configurations
+	secrets     map[types.NamespacedName]bool
+	secretsLock sync.RWMutex
+	// Context of the informers, nil until the cache is started
+	ctx context.Context
+	// Stops the informer of the Secrets of each namespace with referenced Secrets
+	secretInformers map[string]context.CancelFunc
+}
+
+func newConfigCache(kubeClient client.WithWatch) *configCache {
+	return &configCache{
+		kubeClient:      kubeClient,
+		secrets:         map[types.NamespacedName]bool{},
+		secretInformers: map[string]context.CancelFunc{},
+	}
+}
+
+// start watches the custom resources and the referenced secrets until the context is done
+func (c *configCache) start(ctx context.Context) {
+	c.run(ctx, func() client.ObjectList { return &v1alpha1.PrometheusQueryMappingList{} },
+		&v1alpha1.PrometheusQueryMapping{}, v1.NamespaceAll, c.newResourceHandler(specFingerprint, nil))
+	c.run(ctx, func() client.ObjectList { return &v1alpha1.PrometheusServerConfigList{} },
+		&v1alpha1.PrometheusServerConfig{}, v1.NamespaceAll, c.newResourceHandler(specFingerprint, nil))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ctx = ctx
+	c.updateSecretInformers()
+}
+
+// get returns the cached server configurations, or rebuilds them if they are invalidated. Besides the server
+// configurations, build returns the Secrets referenced by all the PrometheusServerConfig resources, so that
+// the creation or the update of a Secret also rebuilds a configuration that failed because of the Secret.
+func (c *configCache) get(build func() ([]*serverConfig, []types.NamespacedName)) []*serverConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.valid.Load() {
+		glog.V(2).Infof("Using %v cached PrometheusServerConfig resources.", len(c.serverConfigs))
+		return c.serverConfigs
+	}
+	// Mark the cache as valid before building it, so that a change during the build invalidates it again
+	c.valid.Store(true)
+	serverConfigs, secretRefs := build()
+	if serverConfigs == nil {
+		// Nothing is found or the custom resources cannot be listed, retry in the next discovery
+		c.valid.Store(false)
+	}
+	secrets := map[types.NamespacedName]bool{}
+	for _, secret := range secretRefs {
+		secrets[secret] = true
+	}
+	c.secretsLock.Lock()
+	c.secrets = secrets
+	c.secretsLock.Unlock()
+	c.updateSecretInformers()
+	c.serverConfigs = serverConfigs
+	return serverConfigs
+}
+
+// updateSecretInformers watches the Secrets of the namespaces with referenced Secrets, and stops watching the
+// other namespaces. It must be called with the lock held.
+func (c *configCache) updateSecretInformers() {
+	if c.ctx == nil {
+		return
+	}
+	namespaces := map[string]bool{}
+	c.secretsLock.RLock()
+	for secret := range c.secrets {
+		namespaces[secret.Namespace] = true
+	}
+	c.secretsLock.RUnlock()
+	for namespace, cancel := range c.secretInformers {
+		if !namespaces[namespace] {
+			glog.V(2).Infof("Stop watching the Secrets in namespace %v.", namespace)
+			cancel()
+			delete(c.secretInformers, namespace)
+		}
+	}
+	for namespace := range namespaces {
+		if _, found := c.secretInformers[namespace]; found {
+			continue
+		}
+		glog.V(2).Infof("Start watching the Secrets in namespace %v.", namespace)
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.secretInformers[namespace] = cancel
+		c.run(ctx, secretMetadataList, &metav1.PartialObjectMetadata{}, namespace,
+			c.newResourceHandler(resourceVersionFingerprint, c.isReferencedSecret))
+	}
+}
+
+// secretMetadataList is the list type of the watch of the Secrets, which only receives their metadata rather
+// than their data
+func secretMetadataList() client.ObjectList {
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(v1.SchemeGroupVersion.WithKind("SecretList"))
+	return list
+}
+
+func (c *configCache) invalidate(reason string) {
+	if c.valid.Swap(false) {
+		glog.V(2).Infof("Invalidated cached custom resources: %v.", reason)
+	}
+}
+
+func (c *configCache) isReferencedSecret(obj client.Object) bool {
+	c.secretsLock.RLock()
+	defer c.secretsLock.RUnlock()
+	return c.secrets[types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}]
+}
+
+// run runs an informer of the resources of the given list type in the namespace, or in all namespaces if empty,
+// until the context is done. The informer lists and watches the resources with the kube client, and resumes the
+// watch or lists the resources again when the watch is closed, so that the handler receives every change.
+func (c *configCache) run(ctx context.Context, newList func() client.ObjectList, obj runtime.Object,
+	namespace string, handler *resourceHandler) {
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list := newList()
+			err := c.kubeClient.List(ctx, list, &client.ListOptions{
+				Namespace: namespace,
+				Limit:     options.Limit,
+				Continue:  options.Continue,
+				Raw:       &options,
+			})
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return c.kubeClient.Watch(ctx, newList(), &client.ListOptions{
+				Namespace: namespace,
+				Raw:       &options,
+			})
+		},
+	}
+	informer := cache.NewSharedIndexInformer(listWatch, obj, 0, cache.Indexers{})
+	if _, err := informer.AddEventHandler(handler); err != nil {
+		glog.Errorf("Failed to handle the changes of %T: %v.", obj, err)
+		return
+	}
+	go informer.Run(ctx.Done())
+}
+
+// resourceHandler invalidates the cache when a resource has changed in a way that matters to the discovery
+type resourceHandler struct {
+	// fingerprint identifies the state of a resource that matters to the discovery
+	fingerprint func(obj client.Object) string
+	// filter selects the resources that matter to the discovery; all resources matter if it is nil
+	filter     func(obj client.Object) bool
+	invalidate func(reason string)
+}
+
+func (c *configCache) newResourceHandler(fingerprint func(obj client.Object) string,
+	filter func(obj client.Object) bool) *resourceHandler {
+	return &resourceHandler{
+		fingerprint: fingerprint,
+		filter:      filter,
+		invalidate:  c.invalidate,
+	}
+}
+
+// OnAdd invalidates the cache for every added resource, including the ones of the initial list, which may have
+// been created after the cached configurations were built
+func (h *resourceHandler) OnAdd(obj interface{}, _ bool) {
+	h.changed(obj, "added")
+}
+
+// OnUpdate invalidates the cache if the fingerprint of the resource has changed, so that neither the status
+// updates nor the updates received again when the informer lists the resources invalidate it
+func (h *resourceHandler) OnUpdate(oldObj, newObj interface{}) {
+	old, ok := oldObj.(client.Object)
+	if !ok {
+		return
+	}
+	if obj, ok := newObj.(client.Object); ok && h.fingerprint(old) != h.fingerprint(obj) {
+		h.changed(obj, "updated")
+	}
+}
+
+func (h *resourceHandler) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		// The deletion was missed while the watch was closed
+		obj = tombstone.Obj
+	}
+	h.changed(obj, "deleted")
+}
+
+func (h *resourceHandler) changed(o interface{}, change string) {
+	obj, ok := o.(client.Object)
+	if !ok || (h.filter != nil && !h.filter(obj)) {
+		return
+	}
+	h.invalidate(fmt.Sprintf("%v/%v %v", obj.GetNamespace(), obj.GetName(), change))
+}
+
+// specFingerprint changes with the spec, the labels and the annotations of a custom resource, but not with
+// its status
+func specFingerprint(obj client.Object) string {
+	return fmt.Sprintf("%d:%v:%v", obj.GetGeneration(), obj.GetLabels(), obj.GetAnnotations())
+}
+
+func resourceVersionFingerprint(obj client.Object) string {
+	return obj.GetResourceVersion()
+}
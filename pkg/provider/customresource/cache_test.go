@@ -0,0 +1,234 @@
+package customresource
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// invalidations records the reasons of the invalidations of a resource handler
+type invalidations []string
+
+func (i *invalidations) invalidate(reason string) {
+	*i = append(*i, reason)
+}
+
+func TestResourceHandlerIgnoresStatusChanges(t *testing.T) {
+	var changes invalidations
+	handler := &resourceHandler{fingerprint: specFingerprint, invalidate: changes.invalidate}
+	istio := createIstio()
+	istio.Generation = 1
+	handler.OnAdd(&istio, true)
+	assert.Equal(t, invalidations{"turbo/istio added"}, changes)
+	// Status update
+	updated := istio.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Status.State = v1alpha1.PrometheusQueryMappingStatusOK
+	handler.OnUpdate(&istio, updated)
+	// Update received again when the informer lists the resources
+	handler.OnUpdate(updated, updated)
+	assert.Equal(t, 1, len(changes))
+	// Label update
+	labeled := updated.DeepCopy()
+	labeled.Labels = map[string]string{"mapping": "istio"}
+	handler.OnUpdate(updated, labeled)
+	// Spec update
+	changed := labeled.DeepCopy()
+	changed.Generation = 2
+	handler.OnUpdate(labeled, changed)
+	// Deletion missed while the watch was closed
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "turbo/istio", Obj: changed})
+	assert.Equal(t, invalidations{"turbo/istio added", "turbo/istio updated", "turbo/istio updated",
+		"turbo/istio deleted"}, changes)
+}
+
+func TestResourceHandlerWithFilter(t *testing.T) {
+	referenced := func(obj client.Object) bool {
+		return obj.GetName() == "prometheus-token"
+	}
+	var changes invalidations
+	handler := &resourceHandler{fingerprint: resourceVersionFingerprint, filter: referenced,
+		invalidate: changes.invalidate}
+	token := &v1.PartialObjectMetadata{ObjectMeta: v1.ObjectMeta{Name: "prometheus-token", Namespace: "turbo", UID: "1", ResourceVersion: "1"}}
+	other := &v1.PartialObjectMetadata{ObjectMeta: v1.ObjectMeta{Name: "other", Namespace: "turbo", UID: "2", ResourceVersion: "1"}}
+	handler.OnAdd(token, false)
+	handler.OnAdd(other, false)
+	updatedToken := token.DeepCopy()
+	updatedToken.ResourceVersion = "2"
+	handler.OnUpdate(token, updatedToken)
+	updatedOther := other.DeepCopy()
+	updatedOther.ResourceVersion = "2"
+	handler.OnUpdate(other, updatedOther)
+	handler.OnDelete(updatedOther)
+	assert.Equal(t, invalidations{"turbo/prometheus-token added", "turbo/prometheus-token updated"}, changes)
+}
+
+func TestConfigCache(t *testing.T) {
+	c := newConfigCache(nil)
+	builds := 0
+	build := func() ([]*serverConfig, []types.NamespacedName) {
+		builds++
+		multiCluster := createMultiSvrConfig()
+		multiCluster.Spec.BearerToken.SecretKeyRef.Name = "prometheus-token"
+		return convertToServerConfigs(
+			[]v1alpha1.PrometheusQueryMapping{createIstio()},
+			[]v1alpha1.PrometheusServerConfig{multiCluster}, nil), secretRefs(&multiCluster)
+	}
+	serverConfigs := c.get(build)
+	assert.Equal(t, 1, len(serverConfigs))
+	assert.Equal(t, serverConfigs, c.get(build))
+	assert.Equal(t, 1, builds)
+	token := &corev1.Secret{ObjectMeta: v1.ObjectMeta{Name: "prometheus-token", Namespace: "turbo"}}
+	assert.True(t, c.isReferencedSecret(token))
+	c.invalidate("test")
+	c.get(build)
+	assert.Equal(t, 2, builds)
+}
+
+// watchRecorder is a client listing no resources and recording the active watches of the Secrets by namespace;
+// its other methods are not implemented
+type watchRecorder struct {
+	client.WithWatch
+	lock          sync.Mutex
+	secretWatches map[string]int
+	// Last watcher of the Secrets of each namespace
+	secretWatchers map[string]*watch.FakeWatcher
+}
+
+func newWatchRecorder() *watchRecorder {
+	return &watchRecorder{
+		secretWatches:  map[string]int{},
+		secretWatchers: map[string]*watch.FakeWatcher{},
+	}
+}
+
+func (r *watchRecorder) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	list.SetResourceVersion("1")
+	return nil
+}
+
+func (r *watchRecorder) Watch(ctx context.Context, list client.ObjectList,
+	opts ...client.ListOption) (watch.Interface, error) {
+	watcher := watch.NewFake()
+	metadataList, ok := list.(*v1.PartialObjectMetadataList)
+	if !ok || metadataList.Kind != "SecretList" {
+		go func() {
+			<-ctx.Done()
+			watcher.Stop()
+		}()
+		return watcher, nil
+	}
+	namespace := opts[0].(*client.ListOptions).Namespace
+	r.lock.Lock()
+	r.secretWatches[namespace]++
+	r.secretWatchers[namespace] = watcher
+	r.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		r.lock.Lock()
+		r.secretWatches[namespace]--
+		if r.secretWatches[namespace] == 0 {
+			delete(r.secretWatches, namespace)
+		}
+		r.lock.Unlock()
+		watcher.Stop()
+	}()
+	return watcher, nil
+}
+
+func (r *watchRecorder) watchedNamespaces() map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	watches := map[string]int{}
+	for namespace, count := range r.secretWatches {
+		watches[namespace] = count
+	}
+	return watches
+}
+
+func (r *watchRecorder) secretWatcher(namespace string) *watch.FakeWatcher {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.secretWatchers[namespace]
+}
+
+func TestConfigCacheWatchesSecretsOfReferencedNamespaces(t *testing.T) {
+	recorder := newWatchRecorder()
+	c := newConfigCache(recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.start(ctx)
+	assert.Empty(t, recorder.watchedNamespaces())
+
+	withSecret := true
+	build := func() ([]*serverConfig, []types.NamespacedName) {
+		multiCluster := createMultiSvrConfig()
+		if withSecret {
+			multiCluster.Spec.BearerToken.SecretKeyRef.Name = "prometheus-token"
+		}
+		return convertToServerConfigs(
+			[]v1alpha1.PrometheusQueryMapping{createIstio()},
+			[]v1alpha1.PrometheusServerConfig{multiCluster}, nil), secretRefs(&multiCluster)
+	}
+	c.get(build)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]int{"turbo": 1}, recorder.watchedNamespaces())
+	}, time.Second, 10*time.Millisecond)
+	// The watch of a namespace is kept while its Secrets are referenced
+	c.invalidate("test")
+	c.get(build)
+	assert.Equal(t, map[string]int{"turbo": 1}, recorder.watchedNamespaces())
+	withSecret = false
+	c.invalidate("test")
+	c.get(build)
+	assert.Eventually(t, func() bool {
+		return len(recorder.watchedNamespaces()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConfigCacheRebuildsAfterMissingSecretIsCreated(t *testing.T) {
+	recorder := newWatchRecorder()
+	c := newConfigCache(recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.start(ctx)
+
+	secretCreated := false
+	build := func() ([]*serverConfig, []types.NamespacedName) {
+		withoutSecret := createMultiSvrConfig()
+		withSecret := createMultiSvrConfig()
+		withSecret.Name = "with-secret"
+		withSecret.Spec.BearerToken.SecretKeyRef.Name = "prometheus-token"
+		converted := []v1alpha1.PrometheusServerConfig{withoutSecret}
+		if secretCreated {
+			converted = append(converted, withSecret)
+		}
+		// The conversion of the PrometheusServerConfig fails while its Secret is missing, but the Secret is
+		// still referenced
+		return convertToServerConfigs([]v1alpha1.PrometheusQueryMapping{createIstio()}, converted, nil),
+			append(secretRefs(&withoutSecret), secretRefs(&withSecret)...)
+	}
+	assert.Equal(t, 1, len(c.get(build)))
+	assert.True(t, c.valid.Load())
+	assert.Eventually(t, func() bool {
+		return recorder.secretWatcher("turbo") != nil
+	}, time.Second, 10*time.Millisecond)
+
+	secretCreated = true
+	recorder.secretWatcher("turbo").Add(&v1.PartialObjectMetadata{ObjectMeta: v1.ObjectMeta{
+		Name: "prometheus-token", Namespace: "turbo", UID: "1", ResourceVersion: "1"}})
+	assert.Eventually(t, func() bool {
+		return !c.valid.Load()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, len(c.get(build)))
+}
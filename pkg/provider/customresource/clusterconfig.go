@@ -7,18 +7,23 @@ import (
 	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
 )
 
 type clusterConfig struct {
 	clusterId     *v1alpha1.ClusterIdentifier
 	queryMappings []*queryMapping
+	// Client of the server, or of the tenant of a multi-tenant backend that the cluster is discovered from
+	promClient *prometheus.RestClient
 }
 
 func clusterConfigFromCustomResource(specClusterConfig v1alpha1.ClusterConfiguration,
 	queryMappings []*queryMapping) (*clusterConfig, error) {
 	var clusterId *v1alpha1.ClusterIdentifier
 	id := specClusterConfig.Identifier
-	if id.ID != "" {
+	if id.ID != "" || len(id.ClusterLabels) > 0 {
+		// Cluster labels are still needed to scope the queries even if there is no explicit cluster ID
 		clusterId = &id
 	}
 	var filteredQueryMappings []*queryMapping
@@ -10,31 +10,71 @@ import (
 	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
 )
 
-func entityDefFromCustomResource(entityConfig v1alpha1.EntityConfiguration) (*provider.EntityDef, error) {
+// definitionError is an error in an EntityConfiguration, along with the reason reported in the status of the
+// PrometheusQueryMapping resource
+type definitionError struct {
+	reason v1alpha1.PrometheusQueryMappingStatusReason
+	err    error
+}
+
+func (e *definitionError) Error() string {
+	return e.err.Error()
+}
+
+// entityDefFromCustomResource converts an EntityConfiguration into an EntityDef.
+// Invalid metric configurations are skipped and returned as warnings; the EntityDef is still created.
+// The annotations of the PrometheusQueryMapping resource provide the settings that the resource has no field for.
+func entityDefFromCustomResource(entityConfig v1alpha1.EntityConfiguration,
+	annotations map[string]string) (*provider.EntityDef, []error, error) {
 	if entityConfig.Type == "" {
-		return nil, fmt.Errorf("empty EntityDef type")
+		return nil, nil, &definitionError{
+			reason: v1alpha1.PrometheusQueryMappingInvalidMetricDefinition,
+			err:    fmt.Errorf("empty EntityDef type"),
+		}
 	}
 	if !data.IsValidDIFEntity(entityConfig.Type) {
-		return nil, fmt.Errorf("unsupported EntityDef type %v", entityConfig.Type)
+		return nil, nil, &definitionError{
+			reason: v1alpha1.PrometheusQueryMappingInvalidMetricDefinition,
+			err:    fmt.Errorf("unsupported EntityDef type %v", entityConfig.Type),
+		}
 	}
 	var metrics []*provider.MetricDef
+	var warnings []error
 	for _, metricConfig := range entityConfig.MetricConfigs {
 		metric, err := metricDefFromCustomResource(metricConfig)
+		if err == nil {
+			err = setMetricAnnotations(metric, annotations, entityConfig.Type)
+		}
 		if err != nil {
 			glog.Warningf("Failed to create metricDefs for %v [%v]: %v",
 				entityConfig.Type, metricConfig.Type, err)
+			warnings = append(warnings, &definitionError{
+				reason: v1alpha1.PrometheusQueryMappingInvalidMetricDefinition,
+				err:    fmt.Errorf("failed to create metricDefs for %v [%v]: %v", entityConfig.Type, metricConfig.Type, err),
+			})
 		} else {
 			metrics = append(metrics, metric)
 		}
 	}
 	attributes, err := attributesFromCustomResource(entityConfig.AttributeConfigs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AttributeDefs for EntityDef type %v: %v", entityConfig.Type, err)
+		return nil, warnings, &definitionError{
+			reason: v1alpha1.PrometheusQueryMappingInvalidAttributeDefinition,
+			err:    fmt.Errorf("failed to create AttributeDefs for EntityDef type %v: %v", entityConfig.Type, err),
+		}
+	}
+	enrichments, err := enrichDefs(annotations, entityConfig.Type)
+	if err != nil {
+		return nil, warnings, &definitionError{
+			reason: v1alpha1.PrometheusQueryMappingInvalidAttributeDefinition,
+			err:    fmt.Errorf("failed to create enrichDefs for EntityDef type %v: %v", entityConfig.Type, err),
+		}
 	}
 	return &provider.EntityDef{
 		EType:         entityConfig.Type,
 		HostedOnVM:    entityConfig.HostedOnVM,
 		MetricDefs:    metrics,
 		AttributeDefs: attributes,
-	}, nil
+		Enrichments:   enrichments,
+	}, warnings, nil
 }
@@ -0,0 +1,105 @@
+package customresource
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serverHeaders returns the additional headers of the requests from the annotations of the
+// PrometheusServerConfig resource, reading the values of the secret headers from their Secrets
+func serverHeaders(prometheusServerConfig *v1alpha1.PrometheusServerConfig,
+	kubeClient client.Client) (map[string]string, error) {
+	annotations := prometheusServerConfig.GetAnnotations()
+	headers := map[string]string{}
+	if value := annotations[headersAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &headers); err != nil {
+			return nil, fmt.Errorf("invalid annotation %v: %v", headersAnnotation, err)
+		}
+	}
+	secretRefs, err := headerSecretRefs(annotations)
+	if err != nil {
+		return nil, err
+	}
+	namespace := prometheusServerConfig.GetNamespace()
+	for name, ref := range secretRefs {
+		value, err := getSecretValue(namespace, ref[0], ref[1], kubeClient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header %v: %v", name, err)
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+// headerSecretRefs returns the name and the key of the Secret of each secret header
+func headerSecretRefs(annotations map[string]string) (map[string][2]string, error) {
+	value := annotations[headerSecretsAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	var secretKeys map[string]string
+	if err := json.Unmarshal([]byte(value), &secretKeys); err != nil {
+		return nil, fmt.Errorf("invalid annotation %v: %v", headerSecretsAnnotation, err)
+	}
+	refs := map[string][2]string{}
+	for name, secretKey := range secretKeys {
+		secretName, key, err := parseSecretKeyRef(headerSecretsAnnotation, secretKey)
+		if err != nil {
+			return nil, err
+		}
+		refs[name] = [2]string{secretName, key}
+	}
+	return refs, nil
+}
+
+// headerSecretNames returns the names of the Secrets that the values of the secret headers are read from
+func headerSecretNames(prometheusServerConfig *v1alpha1.PrometheusServerConfig) (names []string) {
+	// An invalid annotation is reported when the server configuration is converted
+	refs, _ := headerSecretRefs(prometheusServerConfig.GetAnnotations())
+	for _, ref := range refs {
+		names = append(names, ref[0])
+	}
+	sort.Strings(names)
+	return
+}
+
+// tenantHeaders returns the headers of each tenant by cluster ID from the annotations of the
+// PrometheusServerConfig resource
+func tenantHeaders(annotations map[string]string) (map[string]map[string]string, error) {
+	value := annotations[tenantsAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	var tenants map[string]map[string]string
+	if err := json.Unmarshal([]byte(value), &tenants); err != nil {
+		return nil, fmt.Errorf("invalid annotation %v: %v", tenantsAnnotation, err)
+	}
+	return tenants, nil
+}
+
+// parseSecretKeyRef parses the "<secret name>/<key>" value of an annotation
+func parseSecretKeyRef(annotation, value string) (string, string, error) {
+	secretName, key, found := strings.Cut(value, "/")
+	if !found || secretName == "" || key == "" {
+		return "", "", fmt.Errorf("invalid annotation %v: %q is not <secret name>/<key>", annotation, value)
+	}
+	return secretName, key, nil
+}
+
+// getSecretValue returns the value of the key of a Secret, without the surrounding white spaces
+func getSecretValue(namespace, name, key string, kubeClient client.Client) (string, error) {
+	secret, err := getSecret(namespace, name, kubeClient)
+	if err != nil {
+		return "", err
+	}
+	value, found := secret.Data[key]
+	if !found {
+		return "", fmt.Errorf("no %v in Secret %v/%v", key, namespace, name)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
@@ -0,0 +1,57 @@
+package customresource
+
+import (
+	"fmt"
+	"strings"
+
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+)
+
+// serverOAuth2Token returns the source of the access tokens obtained with the OAuth2 client credentials in the
+// annotations of the PrometheusServerConfig resource, or nil if there is no OAuth2 annotation
+func serverOAuth2Token(prometheusServerConfig *v1alpha1.PrometheusServerConfig,
+	kubeClient client.Client) (prometheus.TokenSource, error) {
+	annotations := prometheusServerConfig.GetAnnotations()
+	tokenURL := annotations[oauth2TokenURLAnnotation]
+	clientSecretRef := annotations[oauth2ClientSecretAnnotation]
+	if tokenURL == "" && annotations[oauth2ClientIDAnnotation] == "" && clientSecretRef == "" {
+		return nil, nil
+	}
+	if prometheusServerConfig.Spec.BearerToken.SecretKeyRef.Name != "" {
+		return nil, fmt.Errorf("OAuth2 annotations cannot be combined with a bearer token")
+	}
+	oauth2Config := prometheus.OAuth2Config{
+		TokenURL: tokenURL,
+		ClientID: annotations[oauth2ClientIDAnnotation],
+	}
+	if clientSecretRef != "" {
+		secretName, key, err := parseSecretKeyRef(oauth2ClientSecretAnnotation, clientSecretRef)
+		if err != nil {
+			return nil, err
+		}
+		if oauth2Config.ClientSecret, err = getSecretValue(prometheusServerConfig.GetNamespace(),
+			secretName, key, kubeClient); err != nil {
+			return nil, fmt.Errorf("failed to read the OAuth2 client secret: %v", err)
+		}
+	}
+	for _, scope := range strings.Split(annotations[oauth2ScopesAnnotation], ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			oauth2Config.Scopes = append(oauth2Config.Scopes, scope)
+		}
+	}
+	return prometheus.NewOAuth2TokenSource(oauth2Config)
+}
+
+// oauth2SecretNames returns the name of the Secret that the OAuth2 client secret is read from
+func oauth2SecretNames(prometheusServerConfig *v1alpha1.PrometheusServerConfig) []string {
+	// An invalid annotation is reported when the server configuration is converted
+	secretName, _, err := parseSecretKeyRef(oauth2ClientSecretAnnotation,
+		prometheusServerConfig.GetAnnotations()[oauth2ClientSecretAnnotation])
+	if err != nil {
+		return nil
+	}
+	return []string{secretName}
+}
@@ -3,10 +3,12 @@ package customresource
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
@@ -26,26 +28,58 @@ var (
 type MetricProviderImpl struct {
 	kubeClient client.Client
 	k8sSvcId   string
+	// Cache of the converted custom resources, only available if the client supports watch
+	cache *configCache
+	// The server configuration that each pending task is created from, used to update the status
+	// of the PrometheusServerConfig resources when the discovery completes
+	taskOwners     map[*provider.Task]*serverConfig
+	taskOwnersLock sync.Mutex
 }
 
 func (p *MetricProviderImpl) GetTasks() (tasks []*provider.Task) {
 	// Discover custom resources and assemble tasks
+	taskOwners := map[*provider.Task]*serverConfig{}
 	for _, serverCfg := range p.discoverServerConfigs() {
+		serverTaskCount := 0
 		for _, clusterCfg := range serverCfg.clusterConfigs {
 			for _, qryMapping := range clusterCfg.queryMappings {
 				for _, entityDef := range qryMapping.entityDefs {
-					tasks = append(tasks, provider.
-						NewTask(serverCfg.promClient, entityDef).
+					task := provider.
+						NewTask(clusterCfg.promClient, entityDef).
 						WithClusterId(clusterCfg.clusterId).
-						WithK8sSvcId(p.k8sSvcId))
+						WithK8sSvcId(p.k8sSvcId).
+						WithMaxSampleAge(serverCfg.maxSampleAge)
+					tasks = append(tasks, task)
+					taskOwners[task] = serverCfg
+					serverTaskCount++
 				}
 			}
 		}
+		if serverTaskCount == 0 {
+			// There is no task to report the status of this server, update it now
+			p.updateServerConfigStatus(serverCfg, nil)
+		}
+	}
+	p.taskOwnersLock.Lock()
+	defer p.taskOwnersLock.Unlock()
+	for task, serverCfg := range taskOwners {
+		p.taskOwners[task] = serverCfg
 	}
 	return
 }
 
-func (p *MetricProviderImpl) discoverServerConfigs() (serverConfigs []*serverConfig) {
+func (p *MetricProviderImpl) discoverServerConfigs() []*serverConfig {
+	if p.cache != nil {
+		return p.cache.get(p.listServerConfigs)
+	}
+	serverConfigs, _ := p.listServerConfigs()
+	return serverConfigs
+}
+
+// listServerConfigs lists the custom resources and converts them to server configurations. It also returns
+// the Secrets referenced by all the listed PrometheusServerConfig resources, including the ones that failed to
+// be converted, for example because a referenced Secret does not exist yet.
+func (p *MetricProviderImpl) listServerConfigs() (serverConfigs []*serverConfig, secrets []types.NamespacedName) {
 	prometheusQueryMappingList := &v1alpha1.PrometheusQueryMappingList{}
 	if err := p.kubeClient.List(context.TODO(), prometheusQueryMappingList, &listOptions); err != nil {
 		glog.V(2).Infof("Unable to list PrometheusQueryMapping resource: %v.", err)
@@ -68,7 +102,10 @@ func (p *MetricProviderImpl) discoverServerConfigs() (serverConfigs []*serverCon
 		return
 	}
 	glog.V(2).Infof("Discovered %v PrometheusServerConfig resources.", len(prometheusServerConfigs))
-	return convertToServerConfigs(prometheusQueryMappings, prometheusServerConfigs, p.kubeClient)
+	for i := range prometheusServerConfigs {
+		secrets = append(secrets, secretRefs(&prometheusServerConfigs[i])...)
+	}
+	return convertToServerConfigs(prometheusQueryMappings, prometheusServerConfigs, p.kubeClient), secrets
 }
 
 func convertToServerConfigs(
@@ -78,6 +115,7 @@ func convertToServerConfigs(
 	queryMappingMap := make(map[string][]*queryMapping)
 	for _, prometheusQueryMapping := range prometheusQueryMappings {
 		qryMapping := queryMappingFromCustomResource(prometheusQueryMapping)
+		updateQueryMappingStatus(kubeClient, qryMapping)
 		if queryMappings, found := queryMappingMap[prometheusQueryMapping.GetNamespace()]; found {
 			queryMappingMap[prometheusQueryMapping.GetNamespace()] = append(queryMappings, qryMapping)
 		} else {
@@ -90,6 +128,7 @@ func convertToServerConfigs(
 			glog.Errorf("Failed to load %v %v/%v: %v.",
 				prometheusServerConfig.GetObjectKind().GroupVersionKind(),
 				prometheusServerConfig.GetNamespace(), prometheusServerConfig.GetName(), err)
+			updateServerConfigErrorStatus(kubeClient, &prometheusServerConfig, err)
 			continue
 		}
 		serverConfigs = append(serverConfigs, serverCfg)
@@ -102,10 +141,18 @@ func GetMetricProvider(kubeClient client.Client) (provider.MetricProvider, error
 	if err != nil {
 		return nil, err
 	}
-	return &MetricProviderImpl{
+	metricProvider := &MetricProviderImpl{
 		kubeClient: kubeClient,
 		k8sSvcId:   k8sSvcId,
-	}, nil
+		taskOwners: map[*provider.Task]*serverConfig{},
+	}
+	if watchClient, ok := kubeClient.(client.WithWatch); ok {
+		metricProvider.cache = newConfigCache(watchClient)
+		metricProvider.cache.start(context.Background())
+	} else {
+		glog.Warningf("The kubernetes client does not support watch, custom resources are listed in every discovery.")
+	}
+	return metricProvider, nil
 }
 
 func getKubernetesServiceID(kubeClient client.Client) (string, error) {
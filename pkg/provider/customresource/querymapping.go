@@ -1,6 +1,10 @@
 package customresource
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/golang/glog"
 	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
 
@@ -10,22 +14,58 @@ import (
 type queryMapping struct {
 	qryMapping *v1alpha1.PrometheusQueryMapping
 	entityDefs []*provider.EntityDef
+	status     v1alpha1.PrometheusQueryMappingStatus
 }
 
 func queryMappingFromCustomResource(prometheusQueryMapping v1alpha1.PrometheusQueryMapping) *queryMapping {
 	var entityDefs []*provider.EntityDef
-	for _, entityConfig := range prometheusQueryMapping.Spec.EntityConfigs {
-		entityDef, err := entityDefFromCustomResource(entityConfig)
+	var errs []error
+	maxSampleAge, err := maxSampleAge(prometheusQueryMapping.GetAnnotations())
+	if err != nil {
+		glog.Errorf("Ignored the maximum sample age of %v/%v: %v",
+			prometheusQueryMapping.GetNamespace(), prometheusQueryMapping.GetName(), err)
+		errs = append(errs, err)
+	}
+	for i, entityConfig := range prometheusQueryMapping.Spec.EntityConfigs {
+		entityDef, warnings, err := entityDefFromCustomResource(entityConfig, prometheusQueryMapping.GetAnnotations())
+		for _, warning := range warnings {
+			errs = append(errs, fmt.Errorf("entities[%d]: %w", i, warning))
+		}
 		if err != nil {
 			glog.Errorf("Failed to parse EntityConfiguration in %v/%v: %s",
 				prometheusQueryMapping.GetNamespace(), prometheusQueryMapping.GetName(), err)
-			// TODO: Post status
+			errs = append(errs, fmt.Errorf("entities[%d]: %w", i, err))
 			continue
 		}
+		entityDef.MaxSampleAge = maxSampleAge
 		entityDefs = append(entityDefs, entityDef)
 	}
 	return &queryMapping{
 		qryMapping: &prometheusQueryMapping,
 		entityDefs: entityDefs,
+		status:     queryMappingStatus(errs),
+	}
+}
+
+// queryMappingStatus builds the status of a PrometheusQueryMapping resource from the errors found
+// while parsing its EntityConfigurations
+func queryMappingStatus(errs []error) v1alpha1.PrometheusQueryMappingStatus {
+	if len(errs) == 0 {
+		return v1alpha1.PrometheusQueryMappingStatus{
+			State: v1alpha1.PrometheusQueryMappingStatusOK,
+		}
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	status := v1alpha1.PrometheusQueryMappingStatus{
+		State:   v1alpha1.PrometheusQueryMappingStatusError,
+		Message: strings.Join(messages, "; "),
+	}
+	var defErr *definitionError
+	if errors.As(errs[0], &defErr) {
+		status.Reason = defErr.reason
 	}
+	return status
 }
@@ -3,16 +3,25 @@ package customresource
 import (
 	"context"
 	"fmt"
+	"time"
+
 	"github.com/golang/glog"
 	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
 	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// secretTokenMaxAge is how long the bearer token read from a Secret is used before the Secret is read again
+const secretTokenMaxAge = 5 * time.Minute
+
 type serverConfig struct {
+	promSvrConfig  *v1alpha1.PrometheusServerConfig
 	promClient     *prometheus.RestClient
 	clusterConfigs []*clusterConfig
+	// Samples older than this age are dropped; no limit if 0
+	maxSampleAge time.Duration
 }
 
 func serverConfigFromCustomResource(
@@ -22,18 +31,55 @@ func serverConfigFromCustomResource(
 	glog.V(2).Infof("Loading PrometheusServerConfig %v/%v.",
 		prometheusServerConfig.GetNamespace(), prometheusServerConfig.GetName())
 	address := prometheusServerConfig.Spec.Address
-	bearerToken := getServerBearerToken(
+	bearerToken := serverBearerToken(
 		prometheusServerConfig.ObjectMeta.Namespace,
 		prometheusServerConfig.Spec.BearerToken,
 		kubeClient)
 	if len(address) == 0 {
 		return nil, fmt.Errorf("no prometheus server address defined")
 	}
-	promClient, err := prometheus.NewRestClient(address, bearerToken)
+	oauth2Token, err := serverOAuth2Token(&prometheusServerConfig, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	if oauth2Token != nil {
+		bearerToken = oauth2Token
+	}
+	promClient, err := prometheus.NewRestClientWithTokenSource(address, bearerToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create prometheus client from %v: %v",
 			address, err)
 	}
+	if err := setResilience(promClient, prometheusServerConfig.GetAnnotations()); err != nil {
+		return nil, err
+	}
+	signer, err := serverSigV4Signer(&prometheusServerConfig, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		promClient.WithSigV4Signer(signer)
+	}
+	tlsConfig, err := serverTLSConfig(&prometheusServerConfig, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		promClient.WithTLSConfig(tlsConfig)
+	}
+	headers, err := serverHeaders(&prometheusServerConfig, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	promClient.WithHeaders(headers)
+	tenants, err := tenantHeaders(prometheusServerConfig.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	maxSampleAge, err := maxSampleAge(prometheusServerConfig.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
 	// Find all converted queryMappings in the same namespace
 	queryMappings, found := queryMappingMap[prometheusServerConfig.GetNamespace()]
 	if !found {
@@ -60,37 +106,86 @@ func serverConfigFromCustomResource(
 			clusterConfigs = append(clusterConfigs, clusterCfg)
 		}
 	}
+	setTenantClients(clusterConfigs, promClient, tenants)
 	return &serverConfig{
+		promSvrConfig:  &prometheusServerConfig,
 		promClient:     promClient,
 		clusterConfigs: clusterConfigs,
+		maxSampleAge:   maxSampleAge,
 	}, nil
 }
 
-func getServerBearerToken(namespace string, source v1alpha1.BearerTokenSource, kubeClient client.Client) string {
+// setTenantClients sets the client of each cluster, which is a tenant client if the cluster is a tenant of a
+// multi-tenant backend, or the client of the server otherwise
+func setTenantClients(clusterConfigs []*clusterConfig, promClient *prometheus.RestClient,
+	tenants map[string]map[string]string) {
+	found := map[string]bool{}
+	for _, clusterCfg := range clusterConfigs {
+		clusterCfg.promClient = promClient
+		if clusterCfg.clusterId == nil {
+			continue
+		}
+		if headers, isTenant := tenants[clusterCfg.clusterId.ID]; isTenant {
+			clusterCfg.promClient = promClient.ForTenant(headers)
+			found[clusterCfg.clusterId.ID] = true
+		}
+	}
+	for id := range tenants {
+		if !found[id] {
+			glog.Warningf("Ignored tenant %q in annotation %v: there is no cluster with this ID.",
+				id, tenantsAnnotation)
+		}
+	}
+}
+
+// secretRefs returns the Secrets that the PrometheusServerConfig resource reads its credentials from
+func secretRefs(prometheusServerConfig *v1alpha1.PrometheusServerConfig) (secrets []types.NamespacedName) {
+	if name := prometheusServerConfig.Spec.BearerToken.SecretKeyRef.Name; name != "" {
+		secrets = append(secrets, types.NamespacedName{Namespace: prometheusServerConfig.GetNamespace(), Name: name})
+	}
+	names := append(tlsSecretNames(prometheusServerConfig), headerSecretNames(prometheusServerConfig)...)
+	names = append(names, oauth2SecretNames(prometheusServerConfig)...)
+	names = append(names, sigV4SecretNames(prometheusServerConfig)...)
+	for _, name := range names {
+		secrets = append(secrets, types.NamespacedName{Namespace: prometheusServerConfig.GetNamespace(), Name: name})
+	}
+	return
+}
+
+// serverBearerToken returns the source of the bearer token of the server, which reads the token from its Secret
+// every secretTokenMaxAge, or when the server rejects the token, so that a rotated token is used without waiting
+// for the next change of the custom resources. It returns nil if the server has no token.
+func serverBearerToken(namespace string, source v1alpha1.BearerTokenSource,
+	kubeClient client.Client) prometheus.TokenSource {
 	secretName := source.SecretKeyRef.Name
 	secretKey := source.SecretKeyRef.Key
 
 	if len(secretName) == 0 || len(secretKey) == 0 {
-		return ""
+		return nil
 	}
+	name := fmt.Sprintf("Secret %v/%v:%v", namespace, secretName, secretKey)
+	return prometheus.NewCachedTokenSource(name, func(ctx context.Context) (string, error) {
+		return getServerBearerToken(ctx, namespace, secretName, secretKey, kubeClient)
+	}, secretTokenMaxAge)
+}
 
+func getServerBearerToken(ctx context.Context, namespace, secretName, secretKey string,
+	kubeClient client.Client) (string, error) {
 	glog.V(2).Infof("Reading Prometheus Auth Token %v/%v:%v", namespace, secretName, secretKey)
 
 	secret := &v1.Secret{}
-	err := kubeClient.Get(context.Background(), client.ObjectKey{
+	err := kubeClient.Get(ctx, client.ObjectKey{
 		Namespace: namespace,
 		Name:      secretName,
 	}, secret)
 	if err != nil {
-		glog.Errorf("Failed to read Secret %s %v", secretName, err)
-		return ""
+		return "", err
 	}
 	if secret.Type != v1.SecretTypeOpaque {
-		glog.Errorf("Incorrect secret type of Prometheus Auth Token %s", secret.Type)
-		return ""
+		return "", fmt.Errorf("incorrect secret type of Prometheus Auth Token %s", secret.Type)
 	}
 	tokenBytes := secret.Data[secretKey]
 	token := string(tokenBytes)
 	glog.V(2).Infof("Prometheus Auth Token len: %v", len(token))
-	return token
+	return token, nil
 }
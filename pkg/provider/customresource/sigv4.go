@@ -0,0 +1,60 @@
+package customresource
+
+import (
+	"fmt"
+
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+)
+
+const (
+	awsAccessKeyIDKey     = "aws_access_key_id"
+	awsSecretAccessKeyKey = "aws_secret_access_key"
+)
+
+// serverSigV4Signer returns the AWS Signature Version 4 signer of the requests from the annotations of the
+// PrometheusServerConfig resource, or nil if there is no SigV4 annotation
+func serverSigV4Signer(prometheusServerConfig *v1alpha1.PrometheusServerConfig,
+	kubeClient client.Client) (*prometheus.SigV4Signer, error) {
+	annotations := prometheusServerConfig.GetAnnotations()
+	region := annotations[sigV4RegionAnnotation]
+	roleARN := annotations[sigV4RoleARNAnnotation]
+	credentialsSecret := annotations[sigV4CredentialsSecretAnnotation]
+	if region == "" && roleARN == "" && credentialsSecret == "" {
+		return nil, nil
+	}
+	if prometheusServerConfig.Spec.BearerToken.SecretKeyRef.Name != "" || annotations[oauth2TokenURLAnnotation] != "" {
+		return nil, fmt.Errorf("SigV4 annotations cannot be combined with a bearer token or OAuth2")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("missing annotation %v", sigV4RegionAnnotation)
+	}
+	sigV4Config := prometheus.SigV4Config{
+		Region:  region,
+		RoleARN: roleARN,
+	}
+	if credentialsSecret != "" {
+		namespace := prometheusServerConfig.GetNamespace()
+		secret, err := getSecret(namespace, credentialsSecret, kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		sigV4Config.AccessKeyID = string(secret.Data[awsAccessKeyIDKey])
+		sigV4Config.SecretAccessKey = string(secret.Data[awsSecretAccessKeyKey])
+		if sigV4Config.AccessKeyID == "" || sigV4Config.SecretAccessKey == "" {
+			return nil, fmt.Errorf("no %v or %v in Secret %v/%v",
+				awsAccessKeyIDKey, awsSecretAccessKeyKey, namespace, credentialsSecret)
+		}
+	}
+	return prometheus.NewSigV4Signer(sigV4Config)
+}
+
+// sigV4SecretNames returns the name of the Secret that the AWS credentials are read from
+func sigV4SecretNames(prometheusServerConfig *v1alpha1.PrometheusServerConfig) []string {
+	if name := prometheusServerConfig.GetAnnotations()[sigV4CredentialsSecretAnnotation]; name != "" {
+		return []string{name}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package customresource
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
+	"github.ibm.com/turbonomic/prometurbo/pkg/util"
+)
+
+// OnDiscoveryCompleted implements the provider.DiscoveryListener interface.
+// It updates the status of each PrometheusServerConfig resource with the reachability of the server,
+// and the number of entities discovered for each cluster.
+func (p *MetricProviderImpl) OnDiscoveryCompleted(tasks []*provider.Task) {
+	servers, tasksByServer := p.removeTaskOwners(tasks)
+	for _, serverCfg := range servers {
+		p.updateServerConfigStatus(serverCfg, tasksByServer[serverCfg])
+	}
+}
+
+// OnDiscoveryAborted implements the provider.DiscoveryListener interface.
+// The status is not updated from incomplete results, it is only kept until the next complete discovery.
+func (p *MetricProviderImpl) OnDiscoveryAborted(tasks []*provider.Task) {
+	p.removeTaskOwners(tasks)
+}
+
+// removeTaskOwners forgets the owners of the tasks of a finished discovery, and returns the server configurations
+// that own the tasks, in the order of the tasks, with their tasks
+func (p *MetricProviderImpl) removeTaskOwners(tasks []*provider.Task) ([]*serverConfig,
+	map[*serverConfig][]*provider.Task) {
+	tasksByServer := map[*serverConfig][]*provider.Task{}
+	var servers []*serverConfig
+	p.taskOwnersLock.Lock()
+	defer p.taskOwnersLock.Unlock()
+	for _, task := range tasks {
+		serverCfg, found := p.taskOwners[task]
+		if !found {
+			continue
+		}
+		delete(p.taskOwners, task)
+		if _, found := tasksByServer[serverCfg]; !found {
+			servers = append(servers, serverCfg)
+		}
+		tasksByServer[serverCfg] = append(tasksByServer[serverCfg], task)
+	}
+	return servers, tasksByServer
+}
+
+func (p *MetricProviderImpl) updateServerConfigStatus(serverCfg *serverConfig, tasks []*provider.Task) {
+	status := serverConfigStatus(serverCfg, tasks, p.k8sSvcId, metav1.Now())
+	if err := patchServerConfigStatus(p.kubeClient, serverCfg.promSvrConfig, status); err != nil {
+		glog.Errorf("Failed to update the status of PrometheusServerConfig %v/%v: %v.",
+			serverCfg.promSvrConfig.GetNamespace(), serverCfg.promSvrConfig.GetName(), err)
+	}
+}
+
+// serverConfigStatus builds the status of a PrometheusServerConfig resource from the results of the tasks
+// that have queried the server in the last discovery
+func serverConfigStatus(serverCfg *serverConfig, tasks []*provider.Task, k8sSvcId string,
+	discoveryTime metav1.Time) v1alpha1.PrometheusServerConfigStatus {
+	status := v1alpha1.PrometheusServerConfigStatus{
+		State: v1alpha1.PrometheusServerConfigStatusOK,
+	}
+	// The server is unreachable if all tasks failed
+	var taskErr error
+	for _, task := range tasks {
+		if task.Err() == nil {
+			taskErr = nil
+			break
+		}
+		taskErr = task.Err()
+	}
+	if taskErr != nil {
+		status.State = v1alpha1.PrometheusServerConfigStatusError
+		status.Reason = v1alpha1.PrometheusServerConfigConnectionFailure
+		if prometheus.IsAuthError(taskErr) {
+			status.Reason = v1alpha1.PrometheusServerConfigAuthenticationFailure
+		}
+		status.Message = taskErr.Error()
+	}
+	// Count the discovered entities by cluster and entity type
+	entityCounts := map[string]map[string]int32{}
+	for _, task := range tasks {
+		counts, found := entityCounts[task.GetClusterId()]
+		if !found {
+			counts = map[string]int32{}
+			entityCounts[task.GetClusterId()] = counts
+		}
+		for _, entity := range task.Entities() {
+			counts[entity.Type]++
+		}
+	}
+	visited := map[string]bool{}
+	for _, clusterCfg := range serverCfg.clusterConfigs {
+		clusterId := k8sSvcId
+		if clusterCfg.clusterId != nil && clusterCfg.clusterId.ID != "" {
+			clusterId = clusterCfg.clusterId.ID
+		}
+		if visited[clusterId] {
+			continue
+		}
+		visited[clusterId] = true
+		clusterStatus := v1alpha1.ClusterStatus{
+			ID:                clusterId,
+			LastDiscoveryTime: &discoveryTime,
+		}
+		var entityTypes []string
+		for entityType := range entityCounts[clusterId] {
+			entityTypes = append(entityTypes, entityType)
+		}
+		sort.Strings(entityTypes)
+		for _, entityType := range entityTypes {
+			clusterStatus.Entities = append(clusterStatus.Entities, v1alpha1.EntityStatus{
+				Type:  entityType,
+				Count: util.AsPtr(entityCounts[clusterId][entityType]),
+			})
+		}
+		status.Clusters = append(status.Clusters, clusterStatus)
+	}
+	return status
+}
+
+// updateServerConfigErrorStatus updates the status of a PrometheusServerConfig resource that cannot be loaded
+func updateServerConfigErrorStatus(kubeClient client.Client,
+	prometheusServerConfig *v1alpha1.PrometheusServerConfig, err error) {
+	status := v1alpha1.PrometheusServerConfigStatus{
+		State:   v1alpha1.PrometheusServerConfigStatusError,
+		Message: err.Error(),
+	}
+	if reflect.DeepEqual(prometheusServerConfig.Status, status) {
+		return
+	}
+	if err := patchServerConfigStatus(kubeClient, prometheusServerConfig, status); err != nil {
+		glog.Errorf("Failed to update the status of PrometheusServerConfig %v/%v: %v.",
+			prometheusServerConfig.GetNamespace(), prometheusServerConfig.GetName(), err)
+	}
+}
+
+// updateQueryMappingStatus updates the status of a PrometheusQueryMapping resource if it has changed
+func updateQueryMappingStatus(kubeClient client.Client, qryMapping *queryMapping) {
+	prometheusQueryMapping := qryMapping.qryMapping
+	if kubeClient == nil || reflect.DeepEqual(prometheusQueryMapping.Status, qryMapping.status) {
+		return
+	}
+	// The resource may be shared by the cached configurations, so only a copy is patched
+	patched := prometheusQueryMapping.DeepCopy()
+	patched.Status = qryMapping.status
+	err := kubeClient.Status().Patch(context.TODO(), patched, client.MergeFrom(prometheusQueryMapping))
+	if err != nil {
+		glog.Errorf("Failed to update the status of PrometheusQueryMapping %v/%v: %v.",
+			prometheusQueryMapping.GetNamespace(), prometheusQueryMapping.GetName(), err)
+	}
+}
+
+// patchServerConfigStatus patches the status of a copy of the resource, as the resource is shared by the cached
+// configurations and read concurrently by the discoveries
+func patchServerConfigStatus(kubeClient client.Client, prometheusServerConfig *v1alpha1.PrometheusServerConfig,
+	status v1alpha1.PrometheusServerConfigStatus) error {
+	if kubeClient == nil {
+		return nil
+	}
+	patched := prometheusServerConfig.DeepCopy()
+	patched.Status = status
+	return kubeClient.Status().Patch(context.TODO(), patched, client.MergeFrom(prometheusServerConfig))
+}
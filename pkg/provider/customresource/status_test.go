@@ -0,0 +1,144 @@
+package customresource
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
+)
+
+func TestQueryMappingStatusWithValidMapping(t *testing.T) {
+	qryMapping := queryMappingFromCustomResource(createIstio())
+	assert.Equal(t, v1alpha1.PrometheusQueryMappingStatusOK, qryMapping.status.State)
+	assert.Empty(t, qryMapping.status.Message)
+}
+
+func TestQueryMappingStatusWithInvalidMapping(t *testing.T) {
+	istio := createIstio()
+	istio.Spec = *istioSpec.DeepCopy()
+	istio.Spec.EntityConfigs[0].MetricConfigs[0].Type = "unknownMetric"
+	istio.Spec.EntityConfigs = append(istio.Spec.EntityConfigs, v1alpha1.EntityConfiguration{
+		Type: "application",
+	})
+	qryMapping := queryMappingFromCustomResource(istio)
+	assert.Equal(t, 1, len(qryMapping.entityDefs))
+	assert.Equal(t, v1alpha1.PrometheusQueryMappingStatusError, qryMapping.status.State)
+	assert.Equal(t, v1alpha1.PrometheusQueryMappingInvalidMetricDefinition, qryMapping.status.Reason)
+	assert.Contains(t, qryMapping.status.Message, "entities[0]")
+	assert.Contains(t, qryMapping.status.Message, "unknownMetric")
+	assert.Contains(t, qryMapping.status.Message, "entities[1]")
+	assert.Contains(t, qryMapping.status.Message, "missing identifier")
+}
+
+func newTasks(t *testing.T, handler http.HandlerFunc) []*provider.Task {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	serverConfigs := convertToServerConfigs(
+		[]v1alpha1.PrometheusQueryMapping{createJmxTomcat()},
+		[]v1alpha1.PrometheusServerConfig{createMultiSvrConfig()}, nil)
+	var tasks []*provider.Task
+	for _, clusterCfg := range serverConfigs[0].clusterConfigs {
+		for _, qryMapping := range clusterCfg.queryMappings {
+			for _, entityDef := range qryMapping.entityDefs {
+				task := provider.NewTask(promClient, entityDef).WithClusterId(clusterCfg.clusterId)
+				task.Run(context.Background())
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	return tasks
+}
+
+func TestServerConfigStatusWithReachableServer(t *testing.T) {
+	tasks := newTasks(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[` +
+			`{"metric":{"instance":"10.0.0.1:8080"},"value":[1700000000,"1"]},` +
+			`{"metric":{"instance":"10.0.0.2:8080"},"value":[1700000000,"1"]}]}}`))
+	})
+	serverCfg := convertToServerConfigs(
+		[]v1alpha1.PrometheusQueryMapping{createJmxTomcat()},
+		[]v1alpha1.PrometheusServerConfig{createMultiSvrConfig()}, nil)[0]
+	discoveryTime := metav1.NewTime(time.Unix(1700000000, 0))
+	status := serverConfigStatus(serverCfg, tasks, "", discoveryTime)
+	assert.Equal(t, v1alpha1.PrometheusServerConfigStatusOK, status.State)
+	assert.Equal(t, 2, len(status.Clusters))
+	for _, clusterStatus := range status.Clusters {
+		assert.Equal(t, &discoveryTime, clusterStatus.LastDiscoveryTime)
+		assert.Equal(t, 1, len(clusterStatus.Entities))
+		assert.Equal(t, "application", clusterStatus.Entities[0].Type)
+		assert.Equal(t, int32(2), *clusterStatus.Entities[0].Count)
+	}
+}
+
+func TestServerConfigStatusWithUnauthorizedServer(t *testing.T) {
+	tasks := newTasks(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	serverCfg := convertToServerConfigs(
+		[]v1alpha1.PrometheusQueryMapping{createJmxTomcat()},
+		[]v1alpha1.PrometheusServerConfig{createMultiSvrConfig()}, nil)[0]
+	status := serverConfigStatus(serverCfg, tasks, "", metav1.Now())
+	assert.Equal(t, v1alpha1.PrometheusServerConfigStatusError, status.State)
+	assert.Equal(t, v1alpha1.PrometheusServerConfigAuthenticationFailure, status.Reason)
+	assert.Equal(t, 2, len(status.Clusters))
+	assert.Empty(t, status.Clusters[0].Entities)
+}
+
+func TestDiscoveryAbortedRemovesTaskOwners(t *testing.T) {
+	serverCfg := convertToServerConfigs(
+		[]v1alpha1.PrometheusQueryMapping{createJmxTomcat()},
+		[]v1alpha1.PrometheusServerConfig{createMultiSvrConfig()}, nil)[0]
+	tasks := []*provider.Task{{}, {}}
+	p := &MetricProviderImpl{taskOwners: map[*provider.Task]*serverConfig{}}
+	for _, task := range tasks {
+		p.taskOwners[task] = serverCfg
+	}
+	// The aborted discovery does not update the status, which needs a kube client
+	p.OnDiscoveryAborted(tasks[:1])
+	assert.Equal(t, 1, len(p.taskOwners))
+	p.OnDiscoveryAborted(tasks)
+	assert.Empty(t, p.taskOwners)
+}
+
+// statusRecorder is a client recording the patched statuses; its other methods are not implemented
+type statusRecorder struct {
+	client.Client
+	writer statusWriter
+}
+
+type statusWriter struct {
+	client.SubResourceWriter
+	patched []client.Object
+}
+
+func (r *statusRecorder) Status() client.SubResourceWriter {
+	return &r.writer
+}
+
+func (w *statusWriter) Patch(_ context.Context, obj client.Object, _ client.Patch,
+	_ ...client.SubResourcePatchOption) error {
+	w.patched = append(w.patched, obj)
+	return nil
+}
+
+func TestPatchServerConfigStatusKeepsCachedResource(t *testing.T) {
+	promSvrConfig := createMultiSvrConfig()
+	kubeClient := &statusRecorder{}
+	status := v1alpha1.PrometheusServerConfigStatus{State: v1alpha1.PrometheusServerConfigStatusOK}
+	assert.Nil(t, patchServerConfigStatus(kubeClient, &promSvrConfig, status))
+	assert.Equal(t, 1, len(kubeClient.writer.patched))
+	assert.Equal(t, status, kubeClient.writer.patched[0].(*v1alpha1.PrometheusServerConfig).Status)
+	assert.NotSame(t, &promSvrConfig, kubeClient.writer.patched[0])
+	assert.Empty(t, promSvrConfig.Status.State)
+}
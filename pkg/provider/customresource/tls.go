@@ -0,0 +1,86 @@
+package customresource
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+
+	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+)
+
+const (
+	caKey = "ca.crt"
+)
+
+// serverTLSConfig builds the TLS configuration of the connections to the server from the annotations of the
+// PrometheusServerConfig resource, or returns nil if there is no TLS annotation
+func serverTLSConfig(prometheusServerConfig *v1alpha1.PrometheusServerConfig,
+	kubeClient client.Client) (*tls.Config, error) {
+	annotations := prometheusServerConfig.GetAnnotations()
+	caSecret := annotations[tlsCASecretAnnotation]
+	clientCertSecret := annotations[tlsClientCertSecretAnnotation]
+	serverName := annotations[tlsServerNameAnnotation]
+	insecureValue, hasInsecure := annotations[tlsInsecureSkipVerifyAnnotation]
+	if caSecret == "" && clientCertSecret == "" && serverName == "" && !hasInsecure {
+		return nil, nil
+	}
+	options := prometheus.TLSOptions{
+		ServerName: serverName,
+	}
+	if hasInsecure {
+		insecure, err := strconv.ParseBool(insecureValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %v: %q", tlsInsecureSkipVerifyAnnotation, insecureValue)
+		}
+		options.InsecureSkipVerify = insecure
+	}
+	namespace := prometheusServerConfig.GetNamespace()
+	if caSecret != "" {
+		secret, err := getSecret(namespace, caSecret, kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		if options.CA = secret.Data[caKey]; len(options.CA) == 0 {
+			return nil, fmt.Errorf("no %v in Secret %v/%v", caKey, namespace, caSecret)
+		}
+	}
+	if clientCertSecret != "" {
+		secret, err := getSecret(namespace, clientCertSecret, kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		options.Cert = secret.Data[v1.TLSCertKey]
+		options.Key = secret.Data[v1.TLSPrivateKeyKey]
+		if len(options.Cert) == 0 || len(options.Key) == 0 {
+			return nil, fmt.Errorf("no %v or %v in Secret %v/%v",
+				v1.TLSCertKey, v1.TLSPrivateKeyKey, namespace, clientCertSecret)
+		}
+	}
+	return prometheus.NewTLSConfig(options)
+}
+
+// tlsSecretNames returns the names of the Secrets that the TLS configuration is read from
+func tlsSecretNames(prometheusServerConfig *v1alpha1.PrometheusServerConfig) (names []string) {
+	for _, annotation := range []string{tlsCASecretAnnotation, tlsClientCertSecretAnnotation} {
+		if name := prometheusServerConfig.GetAnnotations()[annotation]; name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func getSecret(namespace, name string, kubeClient client.Client) (*v1.Secret, error) {
+	secret := &v1.Secret{}
+	if err := kubeClient.Get(context.Background(), client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}, secret); err != nil {
+		return nil, fmt.Errorf("failed to read Secret %v/%v: %v", namespace, name, err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+)
+
+// EnrichDef defines an auxiliary query, usually of an "info" metric such as kube_pod_info, whose series labels
+// are joined onto the series of the metric queries of an EntityDef before the attributes are reconciled
+type EnrichDef struct {
+	Query string
+	// On are the labels whose values must be equal in the info series and in the metric series to join them
+	On []string
+	// Labels are the labels of the info series to add to the metric series; all labels other than the metric
+	// name and the join labels are added if empty. The labels that a metric series already has are never
+	// overwritten.
+	Labels []string
+}
+
+func NewEnrichDef(query string, on, labels []string) (*EnrichDef, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("empty enrich query")
+	}
+	if len(on) == 0 {
+		return nil, fmt.Errorf("no join label for enrich query %q", query)
+	}
+	for _, label := range on {
+		if label == "" {
+			return nil, fmt.Errorf("empty join label for enrich query %q", query)
+		}
+	}
+	return &EnrichDef{
+		Query:  query,
+		On:     on,
+		Labels: labels,
+	}, nil
+}
+
+// enrichment is the result of an enrich query, indexed by the values of the join labels
+type enrichment struct {
+	def   *EnrichDef
+	index map[string]map[string]string
+}
+
+// newEnrichment runs the enrich query, and indexes the labels of its series by the values of the join labels.
+// When multiple series have the same join label values, the one whose sorted labels come first is used, so
+// that the choice does not depend on the order of the series returned by the server.
+func newEnrichment(ctx context.Context, t *Task, def *EnrichDef) (*enrichment, error) {
+	query, err := t.scopeQuery(def.Query)
+	if err != nil {
+		return nil, err
+	}
+	metricSeries, err := t.queryCache.GetMetrics(ctx, t.source, query)
+	if err != nil {
+		return nil, err
+	}
+	e := &enrichment{def: def, index: map[string]map[string]string{}}
+	duplicates, ambiguous := 0, 0
+	for _, metricData := range metricSeries {
+		d, ok := metricData.(*prometheus.BasicMetricData)
+		if !ok {
+			return nil, fmt.Errorf("unsupported metric data type %T of enrich query", metricData)
+		}
+		joinKey, found := e.joinKey(d.Labels)
+		if !found {
+			continue
+		}
+		existing, exists := e.index[joinKey]
+		if !exists {
+			e.index[joinKey] = d.Labels
+			continue
+		}
+		duplicates++
+		if !e.sameInfoLabels(existing, d.Labels) {
+			ambiguous++
+		}
+		if labelsString(d.Labels) < labelsString(existing) {
+			e.index[joinKey] = d.Labels
+		}
+	}
+	if ambiguous > 0 {
+		glog.Warningf("Found %d series of enrich query [%v] with the values of labels %v of another series "+
+			"but different labels to add; the labels of the first series in label order are added.",
+			ambiguous, query, def.On)
+	} else if duplicates > 0 {
+		glog.V(2).Infof("Ignored %d series of enrich query [%v] with duplicated values of labels %v.",
+			duplicates, query, def.On)
+	}
+	return e, nil
+}
+
+// infoLabels returns the labels of the info series to add to the metric series
+func (e *enrichment) infoLabels(labels map[string]string) map[string]string {
+	infoLabels := map[string]string{}
+	if len(e.def.Labels) > 0 {
+		for _, name := range e.def.Labels {
+			if value, found := labels[name]; found {
+				infoLabels[name] = value
+			}
+		}
+		return infoLabels
+	}
+	for name, value := range labels {
+		infoLabels[name] = value
+	}
+	delete(infoLabels, model.MetricNameLabel)
+	for _, name := range e.def.On {
+		delete(infoLabels, name)
+	}
+	return infoLabels
+}
+
+// sameInfoLabels tells whether two info series add the same labels
+func (e *enrichment) sameInfoLabels(labels1, labels2 map[string]string) bool {
+	return labelsString(e.infoLabels(labels1)) == labelsString(e.infoLabels(labels2))
+}
+
+// labelsString returns the labels sorted by name, so that equal label sets have equal strings
+func labelsString(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"\xff"+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// joinKey returns the values of the join labels, or false if a join label is missing
+func (e *enrichment) joinKey(labels map[string]string) (string, bool) {
+	values := make([]string, len(e.def.On))
+	for i, label := range e.def.On {
+		value, found := labels[label]
+		if !found {
+			return "", false
+		}
+		values[i] = value
+	}
+	return strings.Join(values, "\xff"), true
+}
+
+// enrich returns a copy of the labels with the labels of the matching info series added, or the labels
+// unchanged if there is no matching info series. The labels are shared with the query cache so they are never
+// modified.
+func (e *enrichment) enrich(labels map[string]string) map[string]string {
+	joinKey, found := e.joinKey(labels)
+	if !found {
+		return labels
+	}
+	infoLabels, found := e.index[joinKey]
+	if !found {
+		return labels
+	}
+	enriched := e.infoLabels(infoLabels)
+	for name, value := range labels {
+		enriched[name] = value
+	}
+	return enriched
+}
@@ -3,3 +3,12 @@ package provider
 type MetricProvider interface {
 	GetTasks() (tasks []*Task)
 }
+
+// DiscoveryListener is implemented by metric providers that need to know the results of the tasks
+// once a round of discovery has completed. Every round of discovery notifies exactly one of the methods.
+type DiscoveryListener interface {
+	OnDiscoveryCompleted(tasks []*Task)
+	// OnDiscoveryAborted is notified instead of OnDiscoveryCompleted when the discovery has been cancelled,
+	// has timed out or has abandoned some tasks, so the results of the tasks are incomplete
+	OnDiscoveryAborted(tasks []*Task)
+}
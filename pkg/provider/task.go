@@ -1,16 +1,33 @@
 package provider
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
 	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
 	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
 
 	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
+)
+
+// errInvalidValue is returned for a NaN or infinite value
+var errInvalidValue = errors.New("invalid value")
+
+// Errors of the attributes that cannot be reconciled from the labels of a series
+var (
+	errMissingLabel    = errors.New("missing label")
+	errRegexMismatch   = errors.New("pattern mismatch")
+	errEmptyIdentifier = errors.New("empty identifier")
 )
 
 type Task struct {
@@ -18,6 +35,14 @@ type Task struct {
 	entityDef *EntityDef
 	clusterId *v1alpha1.ClusterIdentifier
 	k8sSvcId  string
+	// Cache of the query results shared by the tasks of a discovery cycle
+	queryCache *prometheus.QueryCache
+	// Samples older than this age are dropped unless the EntityDef has its own maximum age; no limit if 0
+	maxSampleAge time.Duration
+	// Result of the last run
+	entities     []*data.DIFEntity
+	err          error
+	staleSamples int
 }
 
 func NewTask(source *prometheus.RestClient, entityDef *EntityDef) *Task {
@@ -37,44 +62,154 @@ func (t *Task) WithK8sSvcId(k8sSvcId string) *Task {
 	return t
 }
 
-// Run implements the ITask Run() interface
-func (t *Task) Run() []*data.DIFEntity {
-	return t.getMetricsForEntity()
+// WithQueryCache shares the results of identical queries with the other tasks using the same cache
+func (t *Task) WithQueryCache(queryCache *prometheus.QueryCache) *Task {
+	t.queryCache = queryCache
+	return t
+}
+
+// WithMaxSampleAge drops the samples older than the given age, unless the EntityDef has its own maximum age
+func (t *Task) WithMaxSampleAge(maxSampleAge time.Duration) *Task {
+	t.maxSampleAge = maxSampleAge
+	return t
+}
+
+// Run implements the ITask Run() interface. The queries are abandoned when the context is done, and the
+// entities discovered by the completed queries are returned. The error is only returned if none of the
+// queries succeeded.
+func (t *Task) Run(ctx context.Context) ([]*data.DIFEntity, error) {
+	t.staleSamples = 0
+	// Reported if the run does not complete, e.g. if it panics
+	t.entities, t.err = nil, fmt.Errorf("task %v did not complete", t)
+	t.entities, t.err = t.getMetricsForEntity(ctx)
+	return t.entities, t.err
+}
+
+// String identifies the task in the logs
+func (t *Task) String() string {
+	return fmt.Sprintf("%v on %v", t.entityDef.EType, t.source.GetHost())
+}
+
+// Entities returns the entities discovered by the last run of the task
+func (t *Task) Entities() []*data.DIFEntity {
+	return t.entities
+}
+
+// Err returns the error of the last run of the task if none of its queries succeeded
+func (t *Task) Err() error {
+	return t.err
 }
 
-func (t *Task) getMetricsForEntity() []*data.DIFEntity {
+// StaleSamples returns the number of samples dropped by the last run of the task because they were too old
+func (t *Task) StaleSamples() int {
+	return t.staleSamples
+}
+
+// Saturated tells whether the prometheus server that the task queries is at its limit of concurrent queries
+func (t *Task) Saturated() bool {
+	return t.source.Saturated()
+}
+
+// GetSource returns the client of the prometheus server that the task queries
+func (t *Task) GetSource() *prometheus.RestClient {
+	return t.source
+}
+
+// GetClusterId returns the ID of the cluster that the discovered entities belong to
+func (t *Task) GetClusterId() string {
+	return t.getClusterId()
+}
+
+func (t *Task) getMetricsForEntity(ctx context.Context) ([]*data.DIFEntity, error) {
 	promClient := t.source
 	entityDef := t.entityDef
 	var entityMetrics []*data.DIFEntity
+	var queryErr error
+	querySucceeded := false
 	entityMetricsMap := map[string]*data.DIFEntity{}
+	// Values of all the series that map to the same entity, aggregated once all queries are completed
+	entityValuesMap := map[string]*entityValues{}
+	maxSampleAge := t.maxSampleAge
+	if entityDef.MaxSampleAge > 0 {
+		maxSampleAge = entityDef.MaxSampleAge
+	}
+	now := time.Now()
+	enrichments := t.getEnrichments(ctx)
+	// Scalar results do not belong to any series, and are set on all entities once they are all discovered
+	var scalarMetrics []scalarMetric
 	for _, metricDef := range entityDef.MetricDefs {
 		entityType := entityDef.EType
 		for metricKind, metricQuery := range metricDef.Queries {
+			if ctx.Err() != nil {
+				break
+			}
 			metricType := metricDef.MType
-			metricSeries, err := promClient.GetMetrics(metricQuery)
+			query, err := t.scopeQuery(metricQuery)
+			if err != nil {
+				glog.Errorf("Failed to scope query %v[%v] [%v] for entity type %v to cluster %v: %v.",
+					metricType, metricKind, metricQuery, entityType, t.getClusterId(), err)
+				continue
+			}
+			useRange := metricDef.Range != nil && metricKind == Used
+			var metricSeries []prometheus.MetricData
+			if useRange {
+				metricSeries, err = t.queryCache.GetRangeMetrics(ctx, promClient, query, metricDef.Range.Window, metricDef.Range.Step)
+			} else {
+				metricSeries, err = t.queryCache.GetMetrics(ctx, promClient, query)
+			}
 			if err != nil {
 				glog.Errorf("Failed to query metric %v[%v] [%v] for entity type %v: %v.",
-					metricType, metricKind, metricQuery, entityType, err)
+					metricType, metricKind, query, entityType, err)
+				queryErr = err
 				continue
 			}
+			querySucceeded = true
+			var sampleAges map[string]time.Duration
+			if maxSampleAge > 0 && len(metricSeries) > 0 && prometheus.IsVectorSelector(query) {
+				sampleAges = t.getSampleAges(ctx, query)
+			}
 			for _, metricData := range metricSeries {
-				basicMetricData, ok := metricData.(*prometheus.BasicMetricData)
-				if !ok {
-					// TODO: Enhance error messages
-					glog.Errorf("Type assertion failed for metricData %+v obtained from %v [%v] for entity type %v.",
-						metricData, metricKind, metricQuery, entityType)
+				if scalar, isScalar := metricData.(*prometheus.ScalarMetricData); isScalar {
+					if difMetricValKind, ok := MetricKindToDIFMetricValKind[metricKind]; ok {
+						scalarMetrics = append(scalarMetrics, scalarMetric{
+							metricType: metricType,
+							kind:       difMetricValKind,
+							value:      metricDef.Conversion.apply(scalar.Value),
+							unit:       metricDef.Conversion.unit(),
+						})
+					}
+					continue
+				}
+				if age, stale := isStale(metricData, sampleAges, now, maxSampleAge); stale {
+					glog.V(3).Infof("Dropped sample of %v [%v] for entity type %v which is %v old: %v",
+						metricKind, metricQuery, entityType, age, metricData)
+					t.staleSamples++
+					selfmetrics.StaleSamples.WithLabelValues(promClient.GetHost(), entityType).Inc()
 					continue
 				}
-				metricValue := basicMetricData.GetValue()
-				if math.IsNaN(metricValue) || math.IsInf(metricValue, 0) {
-					glog.Warningf("Invalid value for metricData %+v obtained from %v [%v] for entity type %v.",
-						metricData, metricKind, metricQuery, entityType)
+				labels, metricValues, err := getMetricValues(metricData, metricKind, metricDef, useRange)
+				if err != nil {
+					glog.Warningf("Invalid value for metricData %+v obtained from %v [%v] for entity type %v: %v.",
+						metricData, metricKind, metricQuery, entityType, err)
+					if errors.Is(err, errInvalidValue) {
+						selfmetrics.QueryErrors.WithLabelValues(promClient.GetHost(), selfmetrics.ReasonNaN).Inc()
+					}
 					continue
 				}
-				entityAttr, err := reconcileAttributes(basicMetricData.Labels, entityDef.AttributeDefs)
+				for _, e := range enrichments {
+					labels = e.enrich(labels)
+				}
+				entityAttr, err := reconcileAttributes(labels, entityDef.AttributeDefs)
 				if err != nil {
 					glog.Errorf("Failed to reconcile attributes from labels %+v obtained from %v [%v] for entity %v: %v.",
-						basicMetricData.Labels, metricKind, metricQuery, entityType, err)
+						labels, metricKind, metricQuery, entityType, err)
+					selfmetrics.QueryErrors.WithLabelValues(promClient.GetHost(), attributeErrorReason(err)).Inc()
+					continue
+				}
+				key, err := metricKey(metricDef.Key, labels, entityAttr)
+				if err != nil {
+					glog.Warningf("Failed to get the key of metric %v from labels %+v obtained from %v [%v] "+
+						"for entity %v: %v.", metricType, labels, metricKind, metricQuery, entityType, err)
 					continue
 				}
 				difEntity, found := entityMetricsMap[entityAttr.ID]
@@ -96,20 +231,271 @@ func (t *Task) getMetricsForEntity() []*data.DIFEntity {
 					}
 					processOwner(difEntity, entityAttr)
 					entityMetricsMap[entityAttr.ID] = difEntity
+					entityValuesMap[entityAttr.ID] = &entityValues{}
 				}
 				// Process metrics
-				if difMetricValKind, ok := MetricKindToDIFMetricValKind[metricKind]; ok {
-					glog.V(4).Infof("Processing %v, %v, %v",
-						difEntity.Name, metricType, difMetricValKind)
-					difEntity.AddMetric(metricType, difMetricValKind, basicMetricData.GetValue(), "")
+				for difMetricValKind, metricValue := range metricValues {
+					entityValuesMap[entityAttr.ID].add(metricDef, difMetricValKind, key, metricValue)
 				}
 			}
 		}
 	}
-	for _, metric := range entityMetricsMap {
+	for id, metric := range entityMetricsMap {
+		for _, values := range entityValuesMap[id].values {
+			value, err := aggregate(values.values, values.metricDef.SeriesAggregation)
+			if err != nil {
+				glog.Errorf("Failed to aggregate %v values %v of %v for entity %v: %v.",
+					values.kind, values.values, values.metricDef.MType, metric.Name, err)
+				continue
+			}
+			glog.V(4).Infof("Processing %v, %v, %v, %q", metric.Name, values.metricDef.MType, values.kind, values.key)
+			conversion := values.metricDef.Conversion
+			metricVal := addMetric(metric, values.metricDef.MType, values.kind, conversion.apply(value), values.key)
+			if unit := conversion.unit(); unit != nil {
+				metricVal.Unit = unit
+			}
+		}
+		for _, scalar := range scalarMetrics {
+			glog.V(4).Infof("Processing scalar %v, %v, %v", metric.Name, scalar.metricType, scalar.kind)
+			addScalarMetric(metric, scalar)
+		}
 		entityMetrics = append(entityMetrics, metric)
 	}
-	return entityMetrics
+	if t.staleSamples > 0 {
+		glog.Warningf("Dropped %d samples older than %v for entity type %v.",
+			t.staleSamples, maxSampleAge, entityDef.EType)
+	}
+	if querySucceeded {
+		queryErr = nil
+	} else if ctx.Err() != nil {
+		queryErr = ctx.Err()
+	}
+	return entityMetrics, queryErr
+}
+
+// entityValues collects the values of all the series that map to an entity, in the order they are returned
+type entityValues struct {
+	values []*metricValues
+}
+
+// metricValues are the values of a kind of a metric with a key
+type metricValues struct {
+	metricDef *MetricDef
+	kind      data.DIFMetricValKind
+	key       string
+	values    []float64
+}
+
+func (e *entityValues) add(metricDef *MetricDef, kind data.DIFMetricValKind, key string, value float64) {
+	for _, v := range e.values {
+		if v.metricDef == metricDef && v.kind == kind && v.key == key {
+			v.values = append(v.values, value)
+			return
+		}
+	}
+	e.values = append(e.values, &metricValues{metricDef: metricDef, kind: kind, key: key, values: []float64{value}})
+}
+
+// metricKey expands the key template of a metric with the attributes of the entity and the labels of the series.
+// A template without any reference is the name of a label or an attribute. An attribute takes precedence over
+// a label with the same name.
+func metricKey(template string, labels map[string]string, entityAttr *EntityAttribute) (string, error) {
+	if template == "" {
+		return "", nil
+	}
+	if !strings.Contains(template, "$") {
+		template = "${" + template + "}"
+	}
+	var missing []string
+	key := os.Expand(template, func(name string) string {
+		if value, found := entityAttr.AsMap[name]; found {
+			return value
+		}
+		if value, found := labels[name]; found {
+			return value
+		}
+		missing = append(missing, name)
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no label or attribute %v for key %q", missing, template)
+	}
+	if key == "" {
+		return "", fmt.Errorf("empty key %q", template)
+	}
+	return key, nil
+}
+
+// getSampleAges returns the age of the latest sample of each series of the query by the labels of the series,
+// or nil if the ages cannot be queried. The timestamps returned with the results are the evaluation times of the
+// query rather than the times of the samples, so the ages are computed by the server. The query must be a vector
+// selector: timestamp() is invalid for the other result types, and returns the evaluation time for the results
+// of functions and aggregations, e.g. rate() or sum(), whose samples are then never stale.
+func (t *Task) getSampleAges(ctx context.Context, query string) map[string]time.Duration {
+	ageQuery := fmt.Sprintf("time() - timestamp(%s)", query)
+	metricSeries, err := t.queryCache.GetMetrics(ctx, t.source, ageQuery)
+	if err != nil {
+		glog.V(3).Infof("Failed to query the sample ages [%v], the timestamps of the samples are used: %v.",
+			ageQuery, err)
+		return nil
+	}
+	ages := map[string]time.Duration{}
+	for _, metricData := range metricSeries {
+		if d, ok := metricData.(*prometheus.BasicMetricData); ok {
+			ages[seriesKey(d.Labels)] = time.Duration(d.Value * float64(time.Second))
+		}
+	}
+	return ages
+}
+
+// seriesKey identifies a series by its labels other than the metric name, which timestamp() drops
+func seriesKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		if name != model.MetricNameLabel {
+			pairs = append(pairs, name+"\xff"+value)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// isStale returns the age of the sample in the metric data, and whether it is older than the maximum age.
+// The age queried from the server is used if available, otherwise the age of the timestamp returned with the
+// sample. The samples without any age are never stale.
+func isStale(metricData prometheus.MetricData, sampleAges map[string]time.Duration, now time.Time,
+	maxSampleAge time.Duration) (time.Duration, bool) {
+	if maxSampleAge <= 0 {
+		return 0, false
+	}
+	var labels map[string]string
+	var timestamp time.Time
+	switch d := metricData.(type) {
+	case *prometheus.BasicMetricData:
+		labels, timestamp = d.Labels, d.Timestamp
+	case *prometheus.RangeMetricData:
+		labels, timestamp = d.Labels, d.Timestamp
+	}
+	if age, found := sampleAges[seriesKey(labels)]; found {
+		return age, age > maxSampleAge
+	}
+	if timestamp.IsZero() {
+		return 0, false
+	}
+	age := now.Sub(timestamp)
+	return age, age > maxSampleAge
+}
+
+// scalarMetric is a metric value from a scalar result, which applies to all entities of the EntityDef
+type scalarMetric struct {
+	metricType string
+	kind       data.DIFMetricValKind
+	value      float64
+	unit       *data.DIFMetricUnit
+}
+
+// getEnrichments runs the enrich queries of the EntityDef. A failed enrich query is logged and skipped, so that
+// the metrics are still discovered from the series that have all the labels needed by the attributes.
+func (t *Task) getEnrichments(ctx context.Context) []*enrichment {
+	var enrichments []*enrichment
+	for _, def := range t.entityDef.Enrichments {
+		e, err := newEnrichment(ctx, t, def)
+		if err != nil {
+			glog.Errorf("Failed to run enrich query [%v] for entity type %v: %v.", def.Query, t.entityDef.EType, err)
+			continue
+		}
+		enrichments = append(enrichments, e)
+	}
+	return enrichments
+}
+
+// getMetricValues returns the labels of the metric data, and the values to set for each DIF metric value kind.
+// In range mode, the average, min and max values are all derived from the samples of the range query; with a
+// percentile, the max value is the percentile of the samples instead of the maximum sample. Otherwise, the samples of a matrix result are reduced with the aggregation of the metric definition.
+func getMetricValues(metricData prometheus.MetricData, metricKind string, metricDef *MetricDef,
+	useRange bool) (map[string]string, map[data.DIFMetricValKind]float64, error) {
+	metricValues := map[data.DIFMetricValKind]float64{}
+	var labels map[string]string
+	switch d := metricData.(type) {
+	case *prometheus.BasicMetricData:
+		labels = d.Labels
+		if difMetricValKind, ok := MetricKindToDIFMetricValKind[metricKind]; ok {
+			metricValues[difMetricValKind] = d.GetValue()
+		}
+	case *prometheus.RangeMetricData:
+		labels = d.Labels
+		if useRange {
+			metricValues[data.AVERAGE] = d.Average()
+			metricValues[data.MIN] = d.Min()
+			metricValues[data.MAX] = d.Max()
+			if metricDef.Range.Percentile > 0 {
+				metricValues[data.MAX] = d.Percentile(metricDef.Range.Percentile)
+			}
+		} else if difMetricValKind, ok := MetricKindToDIFMetricValKind[metricKind]; ok {
+			aggregation := metricDef.Aggregation
+			if aggregation == "" {
+				aggregation = AggregateAvg
+			}
+			value, err := aggregate(d.Values, aggregation)
+			if err != nil {
+				return nil, nil, err
+			}
+			metricValues[difMetricValKind] = value
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported metric data type %T", metricData)
+	}
+	for difMetricValKind, metricValue := range metricValues {
+		if math.IsNaN(metricValue) || math.IsInf(metricValue, 0) {
+			return nil, nil, fmt.Errorf("%w: %v value %v", errInvalidValue, difMetricValKind, metricValue)
+		}
+	}
+	return labels, metricValues, nil
+}
+
+// aggregate reduces the values with the given aggregation. It defaults to max, which keeps the value unchanged
+// when the same value is returned in multiple series, e.g. after a join that duplicates a series.
+func aggregate(values []float64, aggregation string) (float64, error) {
+	if len(values) == 0 {
+		return 0, fmt.Errorf("no value to aggregate")
+	}
+	result := values[0]
+	switch aggregation {
+	case AggregateSum, AggregateAvg:
+		for _, v := range values[1:] {
+			result += v
+		}
+		if aggregation == AggregateAvg {
+			result /= float64(len(values))
+		}
+	case AggregateMin:
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+	case AggregateMax, "":
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+	case AggregateLast:
+		result = values[len(values)-1]
+	default:
+		return 0, fmt.Errorf("unsupported aggregation %q", aggregation)
+	}
+	return result, nil
+}
+
+// scopeQuery injects the cluster labels of the task, if any, into every vector selector of the query,
+// so that a Prometheus server shared by multiple clusters only returns series of the cluster of this task
+func (t *Task) scopeQuery(query string) (string, error) {
+	if t.clusterId == nil || len(t.clusterId.ClusterLabels) == 0 {
+		return query, nil
+	}
+	scopedQuery, err := prometheus.InjectLabelMatchers(query, t.clusterId.ClusterLabels)
+	if err != nil {
+		return "", err
+	}
+	glog.V(4).Infof("Scoped query [%v] to [%v].", query, scopedQuery)
+	return scopedQuery, nil
 }
 
 func (t *Task) getEntityId(hostedOnVM bool, entityAttr *EntityAttribute) (entityId string) {
@@ -155,6 +541,47 @@ func (t *Task) getMatchingAttribute(hostedOnVM bool, entityAttr *EntityAttribute
 	return
 }
 
+// addScalarMetric sets the value of a scalar result on every key of the metric in the entity, or on the metric
+// without key if the entity has no value for the metric yet
+func addScalarMetric(entity *data.DIFEntity, scalar scalarMetric) {
+	var keys []string
+	for _, metricVal := range entity.Metrics[scalar.metricType] {
+		if metricVal.Key != nil {
+			keys = append(keys, *metricVal.Key)
+		} else {
+			keys = append(keys, "")
+		}
+	}
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	for _, key := range keys {
+		metricVal := addMetric(entity, scalar.metricType, scalar.kind, scalar.value, key)
+		if scalar.unit != nil {
+			metricVal.Unit = scalar.unit
+		}
+	}
+}
+
+// addMetric adds a metric value of the given kind to the DIF entity, and returns the metric value that
+// DIFEntity.AddMetric found or created for the same metric type and key.
+// DIFEntity.AddMetric only sets the average and capacity values, so the max and min values are set here.
+func addMetric(entity *data.DIFEntity, metricType string, kind data.DIFMetricValKind, value float64,
+	key string) *data.DIFMetricVal {
+	entity.AddMetric(metricType, kind, value, key)
+	for _, metricVal := range entity.Metrics[metricType] {
+		if (metricVal.Key == nil && key == "") || (metricVal.Key != nil && *metricVal.Key == key) {
+			if kind == data.MAX {
+				metricVal.Max = &value
+			} else if kind == data.MIN {
+				metricVal.Min = &value
+			}
+			return metricVal
+		}
+	}
+	return nil
+}
+
 func processOwner(entity *data.DIFEntity, entityAttr *EntityAttribute) {
 	if entityAttr.Service != "" {
 		ServicePrefix := "Service-"
@@ -163,6 +590,18 @@ func processOwner(entity *data.DIFEntity, entityAttr *EntityAttribute) {
 	}
 }
 
+// attributeErrorReason classifies the error of reconcileAttributes for the query error metric
+func attributeErrorReason(err error) string {
+	switch {
+	case errors.Is(err, errMissingLabel):
+		return selfmetrics.ReasonMissingLabel
+	case errors.Is(err, errEmptyIdentifier):
+		return selfmetrics.ReasonEmptyIdentifier
+	default:
+		return selfmetrics.ReasonRegexMismatch
+	}
+}
+
 func reconcileAttributes(labels map[string]string, attributeDefs map[string]*AttributeValueDef) (*EntityAttribute, error) {
 	var id string
 	reconciledAttributes := map[string]string{}
@@ -177,7 +616,8 @@ func reconcileAttributes(labels map[string]string, attributeDefs map[string]*Att
 		}
 		if len(values) < 1 {
 			if def.IsIdentifier {
-				return nil, fmt.Errorf("required identifer label %v does not exist", def.LabelKeys)
+				return nil, fmt.Errorf("%w: required identifer label %v does not exist",
+					errMissingLabel, def.LabelKeys)
 			}
 			continue
 		}
@@ -185,18 +625,18 @@ func reconcileAttributes(labels map[string]string, attributeDefs map[string]*Att
 		glog.V(4).Infof("Reconcile attribute %v with label: %q, value: %q", name, def.LabelKeys, value)
 		matchIndex := def.ValueMatches.FindStringSubmatchIndex(value)
 		if matchIndex == nil {
-			return nil, fmt.Errorf("%v label's value %q did not match expected pattern %q. "+
+			return nil, fmt.Errorf("%w: %v label's value %q did not match expected pattern %q. "+
 				"Please consider changing the pattern in promql."+
 				"This may also happen if label key or it's expected value is longer than 63 chars. "+
 				"Kubernetes character limit for label key and value is 63",
-				def.LabelKeys, value, def.ValueMatches.String())
+				errRegexMismatch, def.LabelKeys, value, def.ValueMatches.String())
 		}
 		expandedValue := def.ValueMatches.ExpandString(nil, def.ValueAs, value, matchIndex)
 		reconciledAttributes[name] = string(expandedValue)
 		if def.IsIdentifier {
 			id = reconciledAttributes[name]
 			if id == "" {
-				return nil, fmt.Errorf("empty identifier from label key %v and value %q", def.LabelKeys, value)
+				return nil, fmt.Errorf("%w from label key %v and value %q", errEmptyIdentifier, def.LabelKeys, value)
 			}
 		}
 	}
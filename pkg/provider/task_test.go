@@ -1,10 +1,22 @@
 package provider
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
 	"github.ibm.com/turbonomic/turbo-metrics/api/v1alpha1"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
 )
 
 var (
@@ -68,3 +80,443 @@ func TestGetEntityIdWithNoId(t *testing.T) {
 	entityIdForAppOnContainer := taskWithNoId.getEntityId(false, entityAttr)
 	assert.Equal(t, "10.254.15.158-demoapp", entityIdForAppOnContainer)
 }
+
+func TestScopeQueryWithClusterLabels(t *testing.T) {
+	query, err := taskWithClusterIdK8sId.scopeQuery(`rate(istio_requests_total{reporter="destination"}[1m])`)
+	assert.Nil(t, err)
+	assert.Equal(t, `rate(istio_requests_total{reporter="destination",cluster="clusterA"}[1m])`, query)
+}
+
+func TestScopeQueryWithoutClusterLabels(t *testing.T) {
+	query, err := taskWithK8sIdOnly.scopeQuery(`rate(istio_requests_total{reporter="destination"}[1m])`)
+	assert.Nil(t, err)
+	assert.Equal(t, `rate(istio_requests_total{reporter="destination"}[1m])`, query)
+}
+
+func newPrometheusServer(results map[string]string) *httptest.Server {
+	return newPrometheusServerWithResultTypes(results, nil)
+}
+
+// newPrometheusServerWithResultTypes returns a server that responds to the queries with the given results,
+// whose result type is vector, or matrix for range queries, unless specified in resultTypes
+func newPrometheusServerWithResultTypes(results, resultTypes map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		result, found := results[query]
+		if !found {
+			result = "[]"
+		}
+		resultType := "vector"
+		if strings.HasSuffix(r.URL.Path, "/query_range") {
+			resultType = "matrix"
+		}
+		if t, found := resultTypes[query]; found {
+			resultType = t
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"` + resultType + `","result":` + result + `}}`))
+	}))
+}
+
+func newEntityDef(metricDefs ...*MetricDef) *EntityDef {
+	return &EntityDef{
+		EType:      "application",
+		HostedOnVM: true,
+		AttributeDefs: map[string]*AttributeValueDef{
+			"ip": {
+				LabelKeys:    []string{"instance"},
+				ValueMatches: regexp.MustCompile(".*"),
+				ValueAs:      "$0",
+				IsIdentifier: true,
+			},
+		},
+		MetricDefs: metricDefs,
+	}
+}
+
+func TestGetMetricsForEntityWithPeak(t *testing.T) {
+	server := newPrometheusServer(map[string]string{
+		"used":     `[{"metric":{"instance":"10.0.0.1"},"value":[1700000000,"100"]}]`,
+		"capacity": `[{"metric":{"instance":"10.0.0.1"},"value":[1700000000,"1000"]}]`,
+		"peak":     `[{"metric":{"instance":"10.0.0.1"},"value":[1700000000,"800"]}]`,
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType: "memory",
+		Queries: map[string]string{
+			Used:     "used",
+			Capacity: "capacity",
+			Peak:     "peak",
+		},
+	})
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	metricVals := entities[0].Metrics["memory"]
+	assert.Equal(t, 1, len(metricVals))
+	assert.Equal(t, 100.0, *metricVals[0].Average)
+	assert.Equal(t, 1000.0, *metricVals[0].Capacity)
+	assert.Equal(t, 800.0, *metricVals[0].Max)
+}
+
+func TestAddMetricWithKey(t *testing.T) {
+	entity := data.NewDIFEntity("10.0.0.1", "application")
+	addMetric(entity, "kpi", data.AVERAGE, 10, "queue1")
+	addMetric(entity, "kpi", data.MAX, 20, "queue1")
+	addMetric(entity, "kpi", data.MAX, 30, "queue2")
+	metricVals := entity.Metrics["kpi"]
+	assert.Equal(t, 2, len(metricVals))
+	assert.Equal(t, 10.0, *metricVals[0].Average)
+	assert.Equal(t, 20.0, *metricVals[0].Max)
+	assert.Nil(t, metricVals[1].Average)
+	assert.Equal(t, 30.0, *metricVals[1].Max)
+}
+
+func TestGetMetricsForEntityWithRange(t *testing.T) {
+	server := newPrometheusServer(map[string]string{
+		"used": `[{"metric":{"instance":"10.0.0.1"},"values":[` +
+			`[1700000000,"10"],[1700000060,"20"],[1700000120,"NaN"],[1700000180,"30"],[1700000240,"40"],[1700000300,"50"]]}]`,
+		"capacity": `[{"metric":{"instance":"10.0.0.1"},"value":[1700000300,"100"]}]`,
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType: "cpu",
+		Queries: map[string]string{
+			Used:     "used",
+			Capacity: "capacity",
+		},
+		Range: &RangeDef{
+			Window:     5 * time.Minute,
+			Step:       time.Minute,
+			Percentile: 75,
+		},
+	})
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	metricVals := entities[0].Metrics["cpu"]
+	assert.Equal(t, 1, len(metricVals))
+	assert.Equal(t, 30.0, *metricVals[0].Average)
+	assert.Equal(t, 10.0, *metricVals[0].Min)
+	assert.Equal(t, 40.0, *metricVals[0].Max)
+	assert.Equal(t, 100.0, *metricVals[0].Capacity)
+}
+
+func TestGetMetricsForEntityWithRangeWithoutPercentile(t *testing.T) {
+	server := newPrometheusServer(map[string]string{
+		"used": `[{"metric":{"instance":"10.0.0.1"},"values":[` +
+			`[1700000000,"10"],[1700000060,"20"],[1700000120,"30"],[1700000180,"40"],[1700000240,"50"]]}]`,
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:   "cpu",
+		Queries: map[string]string{Used: "used"},
+		Range:   &RangeDef{Window: 5 * time.Minute, Step: time.Minute},
+	})
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	metricVals := entities[0].Metrics["cpu"]
+	assert.Equal(t, 1, len(metricVals))
+	assert.Equal(t, 30.0, *metricVals[0].Average)
+	// The minimum and the maximum samples are kept
+	assert.Equal(t, 10.0, *metricVals[0].Min)
+	assert.Equal(t, 50.0, *metricVals[0].Max)
+}
+
+func TestGetMetricsForEntityWithScalarAndMatrix(t *testing.T) {
+	server := newPrometheusServerWithResultTypes(map[string]string{
+		"used": `[{"metric":{"instance":"10.0.0.1"},"values":[[1700000000,"10"],[1700000060,"30"]]},` +
+			`{"metric":{"instance":"10.0.0.2"},"values":[[1700000000,"5"],[1700000060,"7"]]}]`,
+		"capacity": `[1700000060,"64"]`,
+	}, map[string]string{
+		"used":     "matrix",
+		"capacity": "scalar",
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType: "cpu",
+		Queries: map[string]string{
+			Used:     "used",
+			Capacity: "capacity",
+		},
+		Aggregation: AggregateMax,
+	})
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	assert.Equal(t, 2, len(entities))
+	used := map[string]float64{}
+	for _, entity := range entities {
+		metricVals := entity.Metrics["cpu"]
+		assert.Equal(t, 1, len(metricVals))
+		assert.Equal(t, 64.0, *metricVals[0].Capacity)
+		used[entity.Name] = *metricVals[0].Average
+	}
+	assert.Equal(t, map[string]float64{"10.0.0.1": 30, "10.0.0.2": 7}, used)
+}
+
+func TestGetMetricsForEntityWithSeriesAggregation(t *testing.T) {
+	server := newPrometheusServer(map[string]string{
+		"used": `[{"metric":{"instance":"10.0.0.1","code":"200"},"value":[1700000000,"30"]},` +
+			`{"metric":{"instance":"10.0.0.1","code":"500"},"value":[1700000000,"10"]},` +
+			`{"metric":{"instance":"10.0.0.1","code":"404"},"value":[1700000000,"20"]}]`,
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	for aggregation, expected := range map[string]float64{
+		"":            30,
+		AggregateSum:  60,
+		AggregateAvg:  20,
+		AggregateMin:  10,
+		AggregateMax:  30,
+		AggregateLast: 20,
+	} {
+		entityDef := newEntityDef(&MetricDef{
+			MType:             "transaction",
+			Queries:           map[string]string{Used: "used"},
+			SeriesAggregation: aggregation,
+		})
+		entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+		assert.Equal(t, 1, len(entities))
+		metricVals := entities[0].Metrics["transaction"]
+		assert.Equal(t, 1, len(metricVals), aggregation)
+		assert.Equal(t, expected, *metricVals[0].Average, aggregation)
+	}
+}
+
+func TestGetMetricsForEntityWithKey(t *testing.T) {
+	server := newPrometheusServerWithResultTypes(map[string]string{
+		"used": `[{"metric":{"instance":"10.0.0.1","queue":"orders"},"value":[1700000000,"3"]},` +
+			`{"metric":{"instance":"10.0.0.1","queue":"payments"},"value":[1700000000,"5"]},` +
+			`{"metric":{"instance":"10.0.0.1"},"value":[1700000000,"7"]}]`,
+		"capacity": `[1700000000,"100"]`,
+	}, map[string]string{"capacity": "scalar"})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:   "kpi",
+		Queries: map[string]string{Used: "used", Capacity: "capacity"},
+		Key:     "${queue}@${ip}",
+	})
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	metricVals := entities[0].Metrics["kpi"]
+	used := map[string]float64{}
+	for _, metricVal := range metricVals {
+		used[*metricVal.Key] = *metricVal.Average
+		assert.Equal(t, 100.0, *metricVal.Capacity)
+	}
+	// The series without the queue label is skipped
+	assert.Equal(t, map[string]float64{"orders@10.0.0.1": 3, "payments@10.0.0.1": 5}, used)
+}
+
+func TestMetricKey(t *testing.T) {
+	labels := map[string]string{"queue": "orders", "ip": "label-ip"}
+	entityAttr := &EntityAttribute{AsMap: map[string]string{"ip": "10.0.0.1"}}
+	key, err := metricKey("", labels, entityAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, "", key)
+	key, err = metricKey("queue", labels, entityAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, "orders", key)
+	key, err = metricKey("$queue-${ip}", labels, entityAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, "orders-10.0.0.1", key)
+	_, err = metricKey("topic", labels, entityAttr)
+	assert.NotNil(t, err)
+}
+
+func TestGetMetricsForEntityWithConversion(t *testing.T) {
+	server := newPrometheusServer(map[string]string{
+		"used":     `[{"metric":{"instance":"10.0.0.1"},"value":[1700000000,"0.25"]}]`,
+		"capacity": `[{"metric":{"instance":"10.0.0.1"},"value":[1700000000,"2"]}]`,
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	conversion, err := NewConversion("responseTime", "", "secondsToMs", nil, 0)
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:      "responseTime",
+		Queries:    map[string]string{Used: "used", Capacity: "capacity"},
+		Conversion: conversion,
+	})
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	metricVals := entities[0].Metrics["responseTime"]
+	assert.Equal(t, 1, len(metricVals))
+	assert.Equal(t, 250.0, *metricVals[0].Average)
+	assert.Equal(t, 2000.0, *metricVals[0].Capacity)
+	assert.Equal(t, data.MS, *metricVals[0].Unit)
+}
+
+func TestGetMetricsForEntityWithMaxSampleAge(t *testing.T) {
+	now := time.Now().Unix()
+	server := newPrometheusServer(map[string]string{
+		"used": fmt.Sprintf(`[{"metric":{"instance":"10.0.0.1"},"value":[%d,"1"]},`+
+			`{"metric":{"instance":"10.0.0.2"},"value":[%d,"2"]}]`, now, now-600),
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:   "transaction",
+		Queries: map[string]string{Used: "used"},
+	})
+	task := NewTask(promClient, entityDef).WithMaxSampleAge(5 * time.Minute)
+	entities, _ := task.Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	assert.Equal(t, "10.0.0.1", entities[0].Name)
+	assert.Equal(t, 1, task.StaleSamples())
+
+	// The maximum age of the EntityDef overrides the one of the task
+	entityDef.MaxSampleAge = 15 * time.Minute
+	entities, _ = task.Run(context.Background())
+	assert.Equal(t, 2, len(entities))
+	assert.Equal(t, 0, task.StaleSamples())
+}
+
+func TestGetMetricsForEntityWithMaxSampleAgeOfInstantVector(t *testing.T) {
+	// Like Prometheus, the server returns the evaluation time with the samples, and the actual time of the
+	// samples only from timestamp()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		evalTime := r.URL.Query().Get("time")
+		var result string
+		switch r.URL.Query().Get("query") {
+		case "used":
+			result = fmt.Sprintf(`[{"metric":{"__name__":"used","instance":"10.0.0.1"},"value":[%s,"1"]},`+
+				`{"metric":{"__name__":"used","instance":"10.0.0.2"},"value":[%s,"2"]}]`, evalTime, evalTime)
+		case "time() - timestamp(used)":
+			result = fmt.Sprintf(`[{"metric":{"instance":"10.0.0.1"},"value":[%s,"15"]},`+
+				`{"metric":{"instance":"10.0.0.2"},"value":[%s,"600"]}]`, evalTime, evalTime)
+		default:
+			result = "[]"
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":` + result + `}}`))
+	}))
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:   "transaction",
+		Queries: map[string]string{Used: "used"},
+	})
+	task := NewTask(promClient, entityDef).WithMaxSampleAge(5 * time.Minute)
+	entities, _ := task.Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	assert.Equal(t, "10.0.0.1", entities[0].Name)
+	assert.Equal(t, 1, task.StaleSamples())
+}
+
+func TestGetMetricsForEntityWithMaxSampleAgeOfFunction(t *testing.T) {
+	// The ages of the samples are not queried for a query that is not a vector selector
+	var lock sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		queries = append(queries, r.URL.Query().Get("query"))
+		lock.Unlock()
+		evalTime := r.URL.Query().Get("time")
+		result := fmt.Sprintf(`[{"metric":{"instance":"10.0.0.1"},"value":[%s,"1"]}]`, evalTime)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":` + result + `}}`))
+	}))
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:   "transaction",
+		Queries: map[string]string{Used: "sum by (instance) (rate(used[5m]))"},
+	})
+	task := NewTask(promClient, entityDef).WithMaxSampleAge(5 * time.Minute)
+	entities, _ := task.Run(context.Background())
+	assert.Equal(t, 1, len(entities))
+	assert.Equal(t, 0, task.StaleSamples())
+	assert.Equal(t, []string{"sum by (instance) (rate(used[5m]))"}, queries)
+}
+
+func TestGetMetricsForEntityWithEnrichment(t *testing.T) {
+	server := newPrometheusServer(map[string]string{
+		"used": `[{"metric":{"namespace":"shop","pod":"cart-1"},"value":[1700000000,"10"]},` +
+			`{"metric":{"namespace":"shop","pod":"cart-2"},"value":[1700000000,"20"]}]`,
+		"kube_pod_info": `[{"metric":{"namespace":"shop","pod":"cart-1","pod_ip":"10.0.0.1","node":"n1"},` +
+			`"value":[1700000000,"1"]},` +
+			`{"metric":{"namespace":"other","pod":"cart-2","pod_ip":"10.0.0.2","node":"n1"},` +
+			`"value":[1700000000,"1"]}]`,
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	enrichDef, err := NewEnrichDef("kube_pod_info", []string{"namespace", "pod"}, []string{"pod_ip"})
+	assert.Nil(t, err)
+	entityDef := newEntityDef(&MetricDef{
+		MType:   "transaction",
+		Queries: map[string]string{Used: "used"},
+	})
+	entityDef.AttributeDefs["ip"].LabelKeys = []string{"pod_ip"}
+	entityDef.Enrichments = []*EnrichDef{enrichDef}
+	entities, _ := NewTask(promClient, entityDef).Run(context.Background())
+	// The series of cart-2 has no info series in the same namespace, so it has no IP
+	assert.Equal(t, 1, len(entities))
+	assert.Equal(t, "10.0.0.1", entities[0].Name)
+	assert.Equal(t, 10.0, *entities[0].Metrics["transaction"][0].Average)
+}
+
+func TestEnrich(t *testing.T) {
+	e := &enrichment{
+		def: &EnrichDef{On: []string{"pod"}},
+		index: map[string]map[string]string{
+			"cart-1": {"pod": "cart-1", "pod_ip": "10.0.0.1", "node": "n1"},
+		},
+	}
+	labels := map[string]string{"pod": "cart-1", "node": "n2"}
+	enriched := e.enrich(labels)
+	assert.Equal(t, map[string]string{"pod": "cart-1", "pod_ip": "10.0.0.1", "node": "n2"}, enriched)
+	// The labels of the series are never modified
+	assert.Equal(t, map[string]string{"pod": "cart-1", "node": "n2"}, labels)
+	e.def.Labels = []string{"node"}
+	assert.Equal(t, labels, e.enrich(labels))
+	assert.Equal(t, map[string]string{"pod": "cart-2"}, e.enrich(map[string]string{"pod": "cart-2"}))
+	_, err := NewEnrichDef("kube_pod_info", nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestNewEnrichmentWithDuplicatedSeries(t *testing.T) {
+	cart1 := `{"metric":{"__name__":"kube_pod_info","pod":"cart-1","pod_ip":"10.0.0.1","instance":"ksm-1"},` +
+		`"value":[1700000000,"1"]}`
+	cart1Replica := `{"metric":{"__name__":"kube_pod_info","pod":"cart-1","pod_ip":"10.0.0.2","instance":"ksm-2"},` +
+		`"value":[1700000000,"1"]}`
+	server := newPrometheusServer(map[string]string{
+		"info":          "[" + cart1 + "," + cart1Replica + "]",
+		"reversed_info": "[" + cart1Replica + "," + cart1 + "]",
+	})
+	defer server.Close()
+	promClient, err := prometheus.NewRestClient(server.URL, "")
+	assert.Nil(t, err)
+	task := NewTask(promClient, newEntityDef())
+	labels := map[string]string{"pod": "cart-1"}
+	// The series chosen among the series with the same join label values does not depend on their order
+	for _, query := range []string{"info", "reversed_info"} {
+		e, err := newEnrichment(context.Background(), task, &EnrichDef{Query: query, On: []string{"pod"}})
+		assert.Nil(t, err)
+		// The metric name and the join labels of the info series are not added
+		assert.Equal(t, map[string]string{"pod": "cart-1", "pod_ip": "10.0.0.1", "instance": "ksm-1"},
+			e.enrich(labels), query)
+	}
+}
+
+func TestAttributeErrorReason(t *testing.T) {
+	attributeDefs := newEntityDef().AttributeDefs
+	attributeDefs["ip"].ValueMatches = regexp.MustCompile(`^(\d+\.\d+\.\d+\.\d+)?(:\d+)?$`)
+	attributeDefs["ip"].ValueAs = "$1"
+	_, err := reconcileAttributes(map[string]string{"job": "app"}, attributeDefs)
+	assert.Equal(t, selfmetrics.ReasonMissingLabel, attributeErrorReason(err))
+	_, err = reconcileAttributes(map[string]string{"instance": "app-1"}, attributeDefs)
+	assert.Equal(t, selfmetrics.ReasonRegexMismatch, attributeErrorReason(err))
+	_, err = reconcileAttributes(map[string]string{"instance": ":8080"}, attributeDefs)
+	assert.Equal(t, selfmetrics.ReasonEmptyIdentifier, attributeErrorReason(err))
+}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"regexp"
+	"time"
 
 	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
 )
@@ -9,16 +10,56 @@ import (
 const (
 	Used     = "used"
 	Capacity = "capacity"
+	Peak     = "peak"
 )
 
+// Aggregations that reduce multiple values into one, either the samples of a series or the series that map to
+// the same entity
+const (
+	AggregateAvg  = "avg"
+	AggregateSum  = "sum"
+	AggregateMin  = "min"
+	AggregateMax  = "max"
+	AggregateLast = "last"
+)
+
+var Aggregations = map[string]bool{
+	AggregateAvg:  true,
+	AggregateSum:  true,
+	AggregateMin:  true,
+	AggregateMax:  true,
+	AggregateLast: true,
+}
+
 var MetricKindToDIFMetricValKind = map[string]data.DIFMetricValKind{
 	Used:     data.AVERAGE,
 	Capacity: data.CAPACITY,
+	Peak:     data.MAX,
 }
 
 type MetricDef struct {
 	MType   string
 	Queries map[string]string
+	Range   *RangeDef // evaluate the used query over a time range if set
+	// Aggregation reduces the samples of each series in a matrix result of an instant query, e.g. a query
+	// with a range vector selector; the samples are averaged if empty
+	Aggregation string
+	// SeriesAggregation reduces the values of the series that map to the same entity; the maximum value is
+	// used if empty
+	SeriesAggregation string
+	// Key is the name of the label or attribute whose value becomes the key of the metric, or a template
+	// referencing them as $name or ${name}, e.g. "${queue}@${namespace}"; the metric has no key if empty
+	Key string
+	// Conversion converts the values into the unit of the metric; the values are not converted if nil
+	Conversion *Conversion
+}
+
+type RangeDef struct {
+	Window time.Duration
+	Step   time.Duration
+	// Percentile of the samples reported as max instead of the maximum sample, which is then not reported;
+	// the maximum sample is reported if 0
+	Percentile float64
 }
 
 type AttributeValueDef struct {
@@ -34,6 +75,11 @@ type EntityDef struct {
 	HostedOnVM    bool
 	AttributeDefs map[string]*AttributeValueDef
 	MetricDefs    []*MetricDef
+	// Samples older than this age are dropped; the maximum age of the server applies if 0. Only the samples of
+	// the queries that are a vector selector have an age, see prometheus.IsVectorSelector.
+	MaxSampleAge time.Duration
+	// Enrichments add the labels of info series to the series of the metric queries
+	Enrichments []*EnrichDef
 }
 
 type EntityAttribute struct {
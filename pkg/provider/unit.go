@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+)
+
+// Conversion converts the values returned by the queries of a metric into the unit of the metric as
+// value*Scale + Offset
+type Conversion struct {
+	Unit   data.DIFMetricUnit
+	Scale  float64
+	Offset float64
+}
+
+// NamedConversions are the common conversions from the base units used by Prometheus
+var NamedConversions = map[string]Conversion{
+	"bytesToMB":        {Unit: data.MB, Scale: 1.0 / (1024 * 1024)},
+	"kilobytesToMB":    {Unit: data.MB, Scale: 1.0 / 1024},
+	"secondsToMs":      {Unit: data.MS, Scale: 1000},
+	"microsecondsToMs": {Unit: data.MS, Scale: 0.001},
+	"nanosecondsToMs":  {Unit: data.MS, Scale: 0.000001},
+	"ratioToPct":       {Unit: data.PCT, Scale: 100},
+	"hertzToMHz":       {Unit: data.MHZ, Scale: 0.000001},
+	"perMinuteToTps":   {Unit: data.TPS, Scale: 1.0 / 60},
+}
+
+var difMetricUnits = map[data.DIFMetricUnit]bool{
+	data.COUNT: true,
+	data.TPS:   true,
+	data.MS:    true,
+	data.MB:    true,
+	data.MHZ:   true,
+	data.PCT:   true,
+}
+
+// metricTypeUnits are the units that make sense for a metric type; any unit can be used for the other types,
+// e.g. kpi
+var metricTypeUnits = map[string]data.DIFMetricUnit{
+	"responseTime":        data.MS,
+	"serviceTime":         data.MS,
+	"queuingTime":         data.MS,
+	"memory":              data.MB,
+	"heap":                data.MB,
+	"dbMem":               data.MB,
+	"gpuMem":              data.MB,
+	"cpu":                 data.MHZ,
+	"transaction":         data.TPS,
+	"collectionTime":      data.PCT,
+	"remainingGCCapacity": data.PCT,
+	"dbCacheHitRate":      data.PCT,
+	"connection":          data.COUNT,
+	"threads":             data.COUNT,
+	"concurrentQueries":   data.COUNT,
+}
+
+// NewConversion returns the conversion of a metric from a unit, a named conversion, and a scale and an offset,
+// or nil if the values are not converted and no unit is declared. A named conversion cannot be combined with a
+// scale or an offset, and the unit must make sense for the metric type.
+func NewConversion(metricType, unit, name string, scale *float64, offset float64) (*Conversion, error) {
+	var conversion Conversion
+	if name != "" {
+		namedConversion, found := NamedConversions[name]
+		if !found {
+			return nil, fmt.Errorf("unsupported conversion %q", name)
+		}
+		if scale != nil || offset != 0 {
+			return nil, fmt.Errorf("conversion %q cannot be combined with a scale or an offset", name)
+		}
+		if unit != "" && data.DIFMetricUnit(unit) != namedConversion.Unit {
+			return nil, fmt.Errorf("conversion %q converts to %v instead of %v", name, namedConversion.Unit, unit)
+		}
+		conversion = namedConversion
+	} else {
+		if unit == "" && scale == nil && offset == 0 {
+			return nil, nil
+		}
+		conversion = Conversion{Unit: data.DIFMetricUnit(unit), Scale: 1, Offset: offset}
+		if scale != nil {
+			if *scale == 0 {
+				return nil, fmt.Errorf("scale cannot be 0")
+			}
+			conversion.Scale = *scale
+		}
+	}
+	if conversion.Unit != "" {
+		if !difMetricUnits[conversion.Unit] {
+			return nil, fmt.Errorf("unsupported unit %q", conversion.Unit)
+		}
+		if expected, found := metricTypeUnits[metricType]; found && expected != conversion.Unit {
+			return nil, fmt.Errorf("unit %v does not apply to metric type %v, which is in %v",
+				conversion.Unit, metricType, expected)
+		}
+	}
+	return &conversion, nil
+}
+
+// apply converts a value; a nil conversion returns the value unchanged
+func (c *Conversion) apply(value float64) float64 {
+	if c == nil {
+		return value
+	}
+	return value*c.Scale + c.Offset
+}
+
+// unit returns the unit of the converted values, or nil if no unit is declared
+func (c *Conversion) unit() *data.DIFMetricUnit {
+	if c == nil || c.Unit == "" {
+		return nil
+	}
+	unit := c.Unit
+	return &unit
+}
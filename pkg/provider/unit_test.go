@@ -0,0 +1,46 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+)
+
+func TestNewConversion(t *testing.T) {
+	conversion, err := NewConversion("memory", "", "", nil, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, conversion)
+
+	conversion, err = NewConversion("memory", "mb", "bytesToMB", nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data.MB, conversion.Unit)
+	assert.Equal(t, 2.0, conversion.apply(2*1024*1024))
+
+	scale := 0.5
+	conversion, err = NewConversion("kpi", "count", "", &scale, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 6.0, conversion.apply(10))
+
+	conversion, err = NewConversion("kpi", "", "", nil, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, conversion.unit())
+	assert.Equal(t, 10.0, conversion.apply(10))
+
+	for _, tt := range []struct {
+		metricType, unit, name string
+		scale                  *float64
+		offset                 float64
+	}{
+		{metricType: "responseTime", name: "bytesToMB"},
+		{metricType: "memory", unit: "ms"},
+		{metricType: "responseTime", unit: "mb", name: "secondsToMs"},
+		{metricType: "responseTime", name: "secondsToMs", scale: &scale},
+		{metricType: "responseTime", name: "minutesToMs"},
+		{metricType: "kpi", unit: "bytes"},
+		{metricType: "kpi", scale: new(float64)},
+	} {
+		_, err := NewConversion(tt.metricType, tt.unit, tt.name, tt.scale, tt.offset)
+		assert.NotNil(t, err, "%+v", tt)
+	}
+}
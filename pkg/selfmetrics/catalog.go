@@ -0,0 +1,72 @@
+package selfmetrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Reasons of the query errors
+const (
+	ReasonHTTP        = "http"
+	ReasonConnection  = "connection"
+	ReasonAPI         = "api"
+	ReasonDecode      = "decode"
+	ReasonCircuitOpen = "circuit_open"
+	ReasonCancelled   = "cancelled"
+	ReasonNaN         = "nan"
+	// The labels of a series do not make the attributes of an entity
+	ReasonMissingLabel    = "missing_label"
+	ReasonRegexMismatch   = "regex_mismatch"
+	ReasonEmptyIdentifier = "empty_identifier"
+)
+
+// Results of the discovery tasks
+const (
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskPanicked  = "panicked"
+	TaskAbandoned = "abandoned"
+)
+
+// The metrics of prometurbo itself, registered in the Registry
+var (
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometurbo_query_duration_seconds",
+		Help:    "Duration of the requests sent to the Prometheus servers, including the failed attempts.",
+		Buckets: DefaultBuckets,
+	}, []string{"server", "endpoint"})
+	QueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometurbo_query_errors_total",
+		Help: "Failed queries and dropped series by reason: http, connection, api, decode, circuit_open, cancelled, " +
+			"nan, missing_label, regex_mismatch or empty_identifier.",
+	}, []string{"server", "reason"})
+	QuerySeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometurbo_query_series_total",
+		Help: "Series returned by the queries.",
+	}, []string{"server"})
+	StaleSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometurbo_stale_samples_total",
+		Help: "Samples dropped because they are older than the maximum sample age.",
+	}, []string{"server", "type"})
+	Entities = NewSnapshotGaugeVec("prometurbo_entities",
+		"Entities discovered by the last complete discovery.", "type", "cluster")
+	DiscoveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometurbo_discovery_duration_seconds",
+		Help:    "Duration of the discoveries.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"complete"})
+	TaskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometurbo_task_duration_seconds",
+		Help:    "Duration of the discovery tasks by result: succeeded, failed, panicked or abandoned.",
+		Buckets: DefaultBuckets,
+	}, []string{"result"})
+	Workers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometurbo_workers",
+		Help: "Number of workers running the discovery tasks.",
+	})
+	WorkersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometurbo_workers_busy",
+		Help: "Number of workers running a discovery task.",
+	})
+	TasksPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometurbo_tasks_pending",
+		Help: "Number of discovery tasks waiting for a free worker.",
+	})
+)
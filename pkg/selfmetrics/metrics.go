@@ -0,0 +1,56 @@
+package selfmetrics
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets in seconds, suitable for query latencies
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// SnapshotGaugeVec is a set of gauges partitioned by label values which are all replaced at once, so that the
+// gauges of the label values that no longer exist are removed, and the metric is never collected half updated
+type SnapshotGaugeVec struct {
+	desc     *prometheus.Desc
+	snapshot atomic.Pointer[[]snapshotGauge]
+}
+
+type snapshotGauge struct {
+	value       float64
+	labelValues []string
+}
+
+// NewSnapshotGaugeVec creates a gauge to register in a registry
+func NewSnapshotGaugeVec(name, help string, labelNames ...string) *SnapshotGaugeVec {
+	return &SnapshotGaugeVec{desc: prometheus.NewDesc(name, help, labelNames, nil)}
+}
+
+// Update replaces all the gauges with the ones set by the update function
+func (g *SnapshotGaugeVec) Update(update func(set func(v float64, labelValues ...string))) {
+	var gauges []snapshotGauge
+	update(func(v float64, labelValues ...string) {
+		gauges = append(gauges, snapshotGauge{value: v, labelValues: append([]string(nil), labelValues...)})
+	})
+	g.snapshot.Store(&gauges)
+}
+
+// Describe implements prometheus.Collector
+func (g *SnapshotGaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *SnapshotGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	gauges := g.snapshot.Load()
+	if gauges == nil {
+		return
+	}
+	for _, gauge := range *gauges {
+		m, err := prometheus.NewConstMetric(g.desc, prometheus.GaugeValue, gauge.value, gauge.labelValues...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(g.desc, err)
+		}
+		ch <- m
+	}
+}
@@ -0,0 +1,62 @@
+package selfmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, r *prometheus.Registry) string {
+	req := httptest.NewRequest(http.MethodGet, "/selfmetrics", nil)
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(r, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, err := io.ReadAll(rec.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestSnapshotGaugeVecUpdate(t *testing.T) {
+	r := prometheus.NewRegistry()
+	entities := NewSnapshotGaugeVec("test_entities", "Entities.", "type", "cluster")
+	r.MustRegister(entities)
+	assert.Equal(t, "", scrape(t, r))
+	entities.Update(func(set func(v float64, labelValues ...string)) {
+		set(2, "application", "a")
+		set(1, "service", `say "hi"`)
+	})
+	entities.Update(func(set func(v float64, labelValues ...string)) {
+		set(3, "service", `say "hi"`)
+	})
+	assert.Equal(t, `# HELP test_entities Entities.
+# TYPE test_entities gauge
+test_entities{cluster="say \"hi\"",type="service"} 3
+`, scrape(t, r))
+}
+
+func TestSnapshotGaugeVecWithWrongLabelCount(t *testing.T) {
+	r := prometheus.NewRegistry()
+	entities := NewSnapshotGaugeVec("test_entities", "Entities.", "type", "cluster")
+	r.MustRegister(entities)
+	entities.Update(func(set func(v float64, labelValues ...string)) {
+		set(1, "service")
+	})
+	_, err := r.Gather()
+	assert.NotNil(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+	metrics, err := Registry.Gather()
+	assert.Nil(t, err)
+	var names []string
+	for _, m := range metrics {
+		names = append(names, m.GetName())
+	}
+	// The vectors without any labeled series yet are not gathered
+	assert.Equal(t, []string{"prometurbo_tasks_pending", "prometurbo_workers", "prometurbo_workers_busy"}, names)
+}
@@ -0,0 +1,17 @@
+package selfmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds the metrics of prometurbo itself
+var Registry = prometheus.NewRegistry()
+
+// Handler serves the metrics of the Registry in the Prometheus exposition format negotiated with the scraper
+var Handler = promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+
+func init() {
+	Registry.MustRegister(QueryDuration, QueryErrors, QuerySeries, StaleSamples, Entities, DiscoveryDuration,
+		TaskDuration, Workers, WorkersBusy, TasksPending)
+}
@@ -2,18 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
 	dif "github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
 
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
 	"github.ibm.com/turbonomic/prometurbo/pkg/topology"
 	"github.ibm.com/turbonomic/prometurbo/pkg/util"
+	"github.ibm.com/turbonomic/prometurbo/pkg/worker"
 )
 
 var (
@@ -151,31 +158,144 @@ func (s *Server) faviconHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleMetric(w http.ResponseWriter, r *http.Request) {
+	if s.discoveryInterval > 0 {
+		// The discovery runs in the background, serve its last result
+		s.sendSnapshot(w, r)
+		return
+	}
+	// Cancel the outstanding queries when the client disconnects or when the discovery times out
+	entities, _ := s.discover(r.Context())
+	s.sendEntityMetrics(entities, time.Now(), w, r)
+	return
+}
+
+// discover queries the metrics of all tasks of the metric provider and builds the topology entities. The
+// discovery is complete if the context has not been done before all tasks have returned.
+func (s *Server) discover(ctx context.Context) (entities []*dif.DIFEntity, complete bool) {
+	start := time.Now()
+	defer func() {
+		selfmetrics.DiscoveryDuration.WithLabelValues(strconv.FormatBool(complete)).Observe(time.Since(start).Seconds())
+	}()
+	if s.discoveryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.discoveryTimeout)
+		defer cancel()
+	}
+	// Use the same provider and topology for the whole discovery even if they are reloaded in between
+	metricProvider := s.getMetricProvider()
+	businessTopology := s.getTopology()
 	// Assemble the query tasks
-	tasks := s.provider.GetTasks()
+	tasks := interleaveTasks(metricProvider.GetTasks())
+	// Identical queries to the same server are only sent once in this discovery
+	queryCache := prometheus.NewQueryCache(ctx)
+	for _, task := range tasks {
+		task.WithQueryCache(queryCache)
+	}
 	total := len(tasks)
 	glog.V(2).Infof("Total discovery tasks to dispatch %v.", total)
+	// The results of this discovery are collected separately from the ones of concurrent discoveries
+	collector := worker.NewCollector(total)
 	// Dispatch query tasks in a separate goroutine to avoid deadlock
-	go func() {
-		for _, task := range tasks {
-			s.dispatcher.Dispatch(task)
-		}
-	}()
+	workerTasks := make([]worker.ITask, 0, len(tasks))
+	for _, task := range tasks {
+		workerTasks = append(workerTasks, task)
+	}
+	go s.dispatcher.DispatchAll(ctx, workerTasks, collector)
 	// Collect the result
-	entityMetrics := s.dispatcher.CollectResult(total)
+	results := s.dispatcher.CollectResult(ctx, collector, total)
+	entityMetrics, abandoned := mergeResults(results, total)
 	glog.V(2).Infof("Discovered %v entities.", len(entityMetrics))
-	topologyEntities := s.topology.BuildTopologyEntities(entityMetrics)
-	entitiesWithK8s := topology.BuildK8sEntities(topologyEntities)
-	s.sendEntityMetrics(entitiesWithK8s, w, r)
+	hits, misses := queryCache.Stats()
+	glog.V(2).Infof("Sent %v queries, reused the results of %v identical queries.", misses, hits)
+	complete = ctx.Err() == nil
+	if complete && !abandoned {
+		setEntityCounts(tasks)
+	}
+	if listener, ok := metricProvider.(provider.DiscoveryListener); ok {
+		// Notify the provider asynchronously so that the response is not delayed.
+		// An incomplete discovery is notified as aborted as some tasks may still be running.
+		if complete && !abandoned {
+			go listener.OnDiscoveryCompleted(tasks)
+		} else {
+			go listener.OnDiscoveryAborted(tasks)
+		}
+	}
+	topologyEntities := businessTopology.BuildTopologyEntities(entityMetrics)
+	return topology.BuildK8sEntities(topologyEntities), complete
+}
+
+// setEntityCounts sets the entity count metric from the entities discovered by the tasks of a complete discovery
+func setEntityCounts(tasks []*provider.Task) {
+	type entityKey struct{ entityType, cluster string }
+	counts := map[entityKey]int{}
+	for _, task := range tasks {
+		for _, entity := range task.Entities() {
+			counts[entityKey{entity.Type, task.GetClusterId()}]++
+		}
+	}
+	selfmetrics.Entities.Update(func(set func(v float64, labelValues ...string)) {
+		for key, count := range counts {
+			set(float64(count), key.entityType, key.cluster)
+		}
+	})
+}
+
+// interleaveTasks orders the tasks in a round-robin fashion across the prometheus servers, so that the workers
+// are not all waiting for a server whose queries are limited while the tasks of the other servers are pending
+func interleaveTasks(tasks []*provider.Task) []*provider.Task {
+	var sources []*prometheus.RestClient
+	tasksBySource := map[*prometheus.RestClient][]*provider.Task{}
+	for _, task := range tasks {
+		source := task.GetSource()
+		if _, found := tasksBySource[source]; !found {
+			sources = append(sources, source)
+		}
+		tasksBySource[source] = append(tasksBySource[source], task)
+	}
+	interleaved := make([]*provider.Task, 0, len(tasks))
+	for len(interleaved) < len(tasks) {
+		for _, source := range sources {
+			if sourceTasks := tasksBySource[source]; len(sourceTasks) > 0 {
+				interleaved = append(interleaved, sourceTasks[0])
+				tasksBySource[source] = sourceTasks[1:]
+			}
+		}
+	}
+	return interleaved
+}
+
+// mergeResults merges the entities discovered by the tasks, and reports the tasks that have failed or have not
+// completed. It returns whether any task has been abandoned while it may still be running.
+func mergeResults(results []*worker.Result, total int) (entities []*dif.DIFEntity, abandoned bool) {
+	failed := 0
+	for _, result := range results {
+		entities = append(entities, result.Entities...)
+		if result.Err != nil {
+			failed++
+			glog.Errorf("Task %v failed after %v with %d entities discovered: %v.",
+				result.Task, result.Duration, len(result.Entities), result.Err)
+		} else {
+			glog.V(3).Infof("Task %v completed in %v with %d entities discovered.",
+				result.Task, result.Duration, len(result.Entities))
+		}
+		abandoned = abandoned || result.Abandoned
+	}
+	if missing := total - len(results); failed > 0 || missing > 0 {
+		glog.Warningf("Partial discovery: %d of %d tasks failed, %d tasks have not returned.",
+			failed, total, missing)
+	}
 	return
 }
 
-func (s *Server) sendEntityMetrics(entities []*dif.DIFEntity, w http.ResponseWriter, r *http.Request) {
+// sendEntityMetrics sends the topology of the entities discovered at the update time
+func (s *Server) sendEntityMetrics(entities []*dif.DIFEntity, updateTime time.Time, w http.ResponseWriter,
+	r *http.Request) {
 	for _, entity := range entities {
 		glog.V(4).Infof("Adding entity %v", spew.Sdump(entity))
 	}
 	// Create topology
-	topology := dif.NewTopology().SetUpdateTime()
+	topology := dif.NewTopology()
+	topology.Updatetime = updateTime.Unix()
 	topology.Scope = defaultScope
 	// Add entities
 	topology.AddEntities(entities)
@@ -190,6 +310,7 @@ func (s *Server) sendEntityMetrics(entities []*dif.DIFEntity, w http.ResponseWri
 	}
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", updateTime.UTC().Format(http.TimeFormat))
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(result); err != nil {
 		glog.Errorf("Failed to send response: %v.", err)
@@ -197,6 +318,11 @@ func (s *Server) sendEntityMetrics(entities []*dif.DIFEntity, w http.ResponseWri
 	return
 }
 
+// handleSelfMetrics sends the metrics of prometurbo itself in the Prometheus exposition format
+func (s *Server) handleSelfMetrics(w http.ResponseWriter, r *http.Request) {
+	selfmetrics.Handler.ServeHTTP(w, r)
+}
+
 func (s *Server) sendFailure(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusBadGateway)
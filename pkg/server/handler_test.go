@@ -0,0 +1,23 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/prometheus"
+	"github.ibm.com/turbonomic/prometurbo/pkg/provider"
+)
+
+func TestInterleaveTasks(t *testing.T) {
+	clientA, err := prometheus.NewRestClient("http://prometheus-a:9090", "")
+	assert.Nil(t, err)
+	clientB, err := prometheus.NewRestClient("http://prometheus-b:9090", "")
+	assert.Nil(t, err)
+	a1 := provider.NewTask(clientA, &provider.EntityDef{EType: "a1"})
+	a2 := provider.NewTask(clientA, &provider.EntityDef{EType: "a2"})
+	a3 := provider.NewTask(clientA, &provider.EntityDef{EType: "a3"})
+	b1 := provider.NewTask(clientB, &provider.EntityDef{EType: "b1"})
+	b2 := provider.NewTask(clientB, &provider.EntityDef{EType: "b2"})
+	assert.Equal(t, []*provider.Task{a1, b1, a2, b2, a3}, interleaveTasks([]*provider.Task{a1, a2, a3, b1, b2}))
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 
@@ -21,10 +24,22 @@ type Server struct {
 	provider   provider.MetricProvider
 	topology   *topology.BusinessTopology
 	dispatcher *worker.Dispatcher
+	// Maximum duration of a discovery, after which the partial results are returned; no limit if 0
+	discoveryTimeout time.Duration
+	// Interval of the background discovery, whose last result is served; discovery on request if 0
+	discoveryInterval time.Duration
+	// Maximum age of the result of the background discovery, three intervals if 0
+	maxSnapshotAge time.Duration
+	snapshot       *snapshot
+	snapshotLock   sync.RWMutex
+	// Protects the provider and the topology which can be replaced when their configuration is reloaded
+	lock sync.RWMutex
 }
 
 const (
 	metricPath = "/metrics"
+	// The metrics of prometurbo itself, separate from the DIF topology served on metricPath
+	selfMetricPath = "/selfmetrics"
 )
 
 func NewServer(port int) *Server {
@@ -47,24 +62,64 @@ func NewServer(port int) *Server {
 	}
 }
 
+// MetricProvider sets the metric provider. It can be called on a running server to replace the provider.
 func (s *Server) MetricProvider(provider provider.MetricProvider) *Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.provider = provider
 	return s
 }
 
+// Topology sets the business topology. It can be called on a running server to replace the topology.
 func (s *Server) Topology(topology *topology.BusinessTopology) *Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.topology = topology
 	return s
 }
 
+func (s *Server) getMetricProvider() provider.MetricProvider {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.provider
+}
+
+func (s *Server) getTopology() *topology.BusinessTopology {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.topology
+}
+
 func (s *Server) Dispatcher(dispatcher *worker.Dispatcher) *Server {
 	s.dispatcher = dispatcher
 	return s
 }
 
+func (s *Server) DiscoveryTimeout(discoveryTimeout time.Duration) *Server {
+	s.discoveryTimeout = discoveryTimeout
+	return s
+}
+
+// DiscoveryInterval runs the discovery in the background at the interval, and serves the result of the last
+// complete discovery instead of discovering on every request
+func (s *Server) DiscoveryInterval(discoveryInterval time.Duration) *Server {
+	s.discoveryInterval = discoveryInterval
+	return s
+}
+
+// MaxSnapshotAge sets the maximum age of the result of the background discovery, after which an error is
+// returned instead
+func (s *Server) MaxSnapshotAge(maxSnapshotAge time.Duration) *Server {
+	s.maxSnapshotAge = maxSnapshotAge
+	return s
+}
+
 func (s *Server) Run() {
 	// Launch dispatcher to dispatch discovery tasks
 	s.dispatcher.Start()
+	if s.discoveryInterval > 0 {
+		go s.runDiscoveryLoop(context.Background())
+	}
 	// Start the http server to process discovery request
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", s.port),
@@ -88,6 +143,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if strings.EqualFold(path, selfMetricPath) {
+		s.handleSelfMetrics(w, r)
+		return
+	}
+
 	s.handleWelcome(path, w, r)
 	return
 }
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	dif "github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+)
+
+// snapshot is the result of the last complete discovery of the background discovery loop
+type snapshot struct {
+	entities []*dif.DIFEntity
+	// Time when the discovery started, as the samples are at most as old as the queries, and the age of the
+	// snapshot does not depend on how long the discovery took
+	time time.Time
+	// Duration of the discovery
+	duration time.Duration
+}
+
+func (s *Server) getSnapshot() *snapshot {
+	s.snapshotLock.RLock()
+	defer s.snapshotLock.RUnlock()
+	return s.snapshot
+}
+
+func (s *Server) setSnapshot(snapshot *snapshot) {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+	s.snapshot = snapshot
+}
+
+// runDiscoveryLoop runs a discovery at every interval, and keeps the result of the last complete discovery.
+// A discovery that times out is discarded, so that a partial result does not replace a complete one.
+func (s *Server) runDiscoveryLoop(ctx context.Context) {
+	glog.V(2).Infof("Discovering metrics in the background every %v.", s.discoveryInterval)
+	ticker := time.NewTicker(s.discoveryInterval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		entities, complete := s.discover(ctx)
+		duration := time.Since(start)
+		if complete {
+			s.setSnapshot(&snapshot{
+				entities: entities,
+				time:     start,
+				duration: duration,
+			})
+			glog.V(2).Infof("Background discovery of %d entities completed in %v.", len(entities), duration)
+		} else {
+			glog.Errorf("Background discovery did not complete in %v, keeping the result of the "+
+				"previous discovery.", duration)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendSnapshot sends the result of the last complete background discovery, or an error if there is no result
+// yet or if the result is older than the maximum age
+func (s *Server) sendSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.getSnapshot()
+	if snapshot == nil {
+		s.sendUnavailable(w, "no discovery has completed yet")
+		return
+	}
+	age := time.Since(snapshot.time)
+	if maxAge := s.getMaxSnapshotAge(); age > maxAge {
+		glog.Errorf("The last complete discovery started %v ago, exceeding the maximum age %v.", age, maxAge)
+		s.sendUnavailable(w, fmt.Sprintf("the last complete discovery started %v ago, exceeding the maximum age %v",
+			age.Round(time.Second), maxAge))
+		return
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("X-Discovery-Duration", snapshot.duration.Round(time.Millisecond).String())
+	s.sendEntityMetrics(snapshot.entities, snapshot.time, w, r)
+}
+
+// getMaxSnapshotAge returns the maximum age of the snapshot, three discovery intervals by default
+func (s *Server) getMaxSnapshotAge() time.Duration {
+	if s.maxSnapshotAge > 0 {
+		return s.maxSnapshotAge
+	}
+	return 3 * s.discoveryInterval
+}
+
+func (s *Server) sendUnavailable(w http.ResponseWriter, message string) {
+	result, _ := json.Marshal(map[string]string{"status": "error", "message": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := w.Write(result); err != nil {
+		glog.Errorf("Failed to send response: %v.", err)
+	}
+}
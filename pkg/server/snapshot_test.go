@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	dif "github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+)
+
+func TestSendSnapshot(t *testing.T) {
+	s := &Server{discoveryInterval: time.Minute}
+	sendSnapshot := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.sendSnapshot(w, httptest.NewRequest(http.MethodGet, metricPath, nil))
+		return w
+	}
+	// No discovery has completed yet
+	assert.Equal(t, http.StatusServiceUnavailable, sendSnapshot().Code)
+
+	discoveryTime := time.Now().Add(-2 * time.Minute)
+	s.setSnapshot(&snapshot{
+		entities: []*dif.DIFEntity{dif.NewDIFEntity("app", "application")},
+		time:     discoveryTime,
+		duration: time.Second,
+	})
+	w := sendSnapshot()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "120", w.Header().Get("Age"))
+	assert.Equal(t, discoveryTime.UTC().Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+	assert.Contains(t, w.Body.String(), `"uniqueId":"app"`)
+
+	// The snapshot is older than the maximum age
+	s.MaxSnapshotAge(time.Minute)
+	assert.Equal(t, http.StatusServiceUnavailable, sendSnapshot().Code)
+}
@@ -1,40 +1,38 @@
 package worker
 
 import (
-	"sync"
+	"context"
 
 	"github.com/golang/glog"
-	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
 )
 
+// Collector receives the results of the tasks of a single discovery round, so that the results of concurrent
+// discoveries are never mixed
 type Collector struct {
-	resultPool chan []*data.DIFEntity
+	resultPool chan *Result
 }
 
-func NewCollector(maxWorkerNumber int) *Collector {
+// NewCollector creates the collector of a discovery round of taskCount tasks. The results are buffered so
+// that the workers never wait for the results to be collected, even when the discovery is cancelled.
+func NewCollector(taskCount int) *Collector {
 	return &Collector{
-		resultPool: make(chan []*data.DIFEntity, maxWorkerNumber),
+		resultPool: make(chan *Result, taskCount),
 	}
 }
 
-func (m *Collector) collect(count int) (mergedResult []*data.DIFEntity) {
-	stopChan := make(chan struct{})
-	var wg sync.WaitGroup
-	wg.Add(count)
-	go func() {
-		for {
-			select {
-			case <-stopChan:
-				return
-			case result := <-m.resultPool:
-				mergedResult = append(mergedResult, result...)
-				wg.Done()
-			}
+// collect receives the results of count tasks. If the context is done before all results are received, the
+// results received so far are returned, and the remaining results are discarded with the collector.
+func (m *Collector) collect(ctx context.Context, count int) (results []*Result) {
+	for received := 0; received < count; received++ {
+		select {
+		case result := <-m.resultPool:
+			results = append(results, result)
+		case <-ctx.Done():
+			glog.Warningf("Discovery is cancelled with %d of %d tasks unfinished: %v.",
+				count-received, count, ctx.Err())
+			return
 		}
-	}()
-	wg.Wait()
-	// stop the result waiting goroutine.
-	close(stopChan)
+	}
 	glog.V(2).Infof("Collected results from all %d tasks.", count)
 	return
 }
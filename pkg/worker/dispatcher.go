@@ -1,31 +1,38 @@
 package worker
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/golang/glog"
-	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
 )
 
 type Dispatcher struct {
 	workerCount int
-	workerPool  chan chan ITask
-	collector   *Collector
+	workerPool  chan chan job
+	// Maximum duration of a task, no limit if 0
+	taskTimeout time.Duration
 }
 
 func NewDispatcher(workerCount int) *Dispatcher {
 	return &Dispatcher{
 		workerCount: workerCount,
-		workerPool:  make(chan chan ITask, workerCount),
+		workerPool:  make(chan chan job, workerCount),
 	}
 }
 
-func (d *Dispatcher) WithCollector(collector *Collector) *Dispatcher {
-	d.collector = collector
+// WithTaskTimeout cancels a task that runs longer than the timeout, and abandons it if it does not return
+// shortly after
+func (d *Dispatcher) WithTaskTimeout(taskTimeout time.Duration) *Dispatcher {
+	d.taskTimeout = taskTimeout
 	return d
 }
 
 func (d *Dispatcher) Start() {
+	selfmetrics.Workers.Set(float64(d.workerCount))
 	// Create workers
 	for i := 0; i < d.workerCount; i++ {
 		// Create and launch a worker in a separate goroutine
@@ -42,24 +49,55 @@ func (d *Dispatcher) launchWorker(id string) {
 		select {
 		case t := <-worker.taskChan:
 			glog.V(2).Infof("worker %s has received a task.", worker.id)
-			result := worker.execute(t)
-			d.collector.resultPool <- result
+			selfmetrics.WorkersBusy.Add(1)
+			result := worker.execute(t, d.taskTimeout)
+			selfmetrics.WorkersBusy.Add(-1)
+			t.collector.resultPool <- result
 			glog.V(2).Infof("worker %s has finished.", worker.id)
 			d.workerPool <- worker.taskChan
 		}
 	}
 }
 
-// Dispatch a task, block when there is no free worker
-func (d *Dispatcher) Dispatch(t ITask) {
+// Dispatch a task of a discovery round, block when there is no free worker. The result of the task is sent to
+// the collector of the round. The task is dispatched even if the context is done, so that every dispatched task
+// has a result to collect; it is then expected to return immediately.
+func (d *Dispatcher) Dispatch(ctx context.Context, t ITask, collector *Collector) {
 	glog.V(4).Infof("Waiting for a free worker")
 	// Pick a free worker from the worker pool, when its channel frees up
+	selfmetrics.TasksPending.Add(1)
 	taskChannel := <-d.workerPool
+	selfmetrics.TasksPending.Add(-1)
 	// Assign a task to the worker
-	taskChannel <- t
+	taskChannel <- job{ctx: ctx, task: t, collector: collector}
+}
+
+// DispatchAll dispatches the tasks of a discovery round like Dispatch, in order, except that a free worker is
+// given to the first task whose limits are not saturated, so that the workers do not wait for a server at its
+// limit while the tasks of the other servers are pending. The tasks are only dispatched to a saturated server
+// when all the pending tasks are saturated.
+func (d *Dispatcher) DispatchAll(ctx context.Context, tasks []ITask, collector *Collector) {
+	pending := append([]ITask{}, tasks...)
+	selfmetrics.TasksPending.Add(float64(len(pending)))
+	for len(pending) > 0 {
+		glog.V(4).Infof("Waiting for a free worker")
+		taskChannel := <-d.workerPool
+		next := 0
+		for i, t := range pending {
+			if limited, ok := t.(LimitedTask); !ok || !limited.Saturated() {
+				next = i
+				break
+			}
+		}
+		t := pending[next]
+		pending = append(pending[:next], pending[next+1:]...)
+		selfmetrics.TasksPending.Add(-1)
+		taskChannel <- job{ctx: ctx, task: t, collector: collector}
+	}
 }
 
-// CollectResult collects results from this round of discovery
-func (d *Dispatcher) CollectResult(taskCount int) []*data.DIFEntity {
-	return d.collector.collect(taskCount)
+// CollectResult collects results from a round of discovery, or the results collected so far when the
+// context is done
+func (d *Dispatcher) CollectResult(ctx context.Context, collector *Collector, taskCount int) []*Result {
+	return collector.collect(ctx, taskCount)
 }
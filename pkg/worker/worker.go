@@ -1,23 +1,126 @@
 package worker
 
-import "github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/golang/glog"
+	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+
+	"github.ibm.com/turbonomic/prometurbo/pkg/selfmetrics"
+)
+
+// abandonGracePeriod is the time given to a task to return its partial results once its context is done,
+// after which the task is abandoned so that the worker is available again
+var abandonGracePeriod = 5 * time.Second
 
 type ITask interface {
-	Run() []*data.DIFEntity
+	// Run runs the task until it completes or the context is done, and returns the discovered entities along
+	// with the error that prevented the task from discovering them, if any
+	Run(ctx context.Context) ([]*data.DIFEntity, error)
+}
+
+// LimitedTask is a task whose queries are limited, e.g. by the number of concurrent queries to a server
+type LimitedTask interface {
+	ITask
+	// Saturated tells whether the queries of the task would wait for the limits if it started now
+	Saturated() bool
+}
+
+// Result is the result of a task
+type Result struct {
+	Task     ITask
+	Entities []*data.DIFEntity
+	Err      error
+	Duration time.Duration
+	// Abandoned is true if the task has not returned before its deadline and is possibly still running
+	Abandoned bool
+	panicked  bool
+}
+
+// status returns the status of the result for the task duration metric
+func (r *Result) status() string {
+	switch {
+	case r.Abandoned:
+		return selfmetrics.TaskAbandoned
+	case r.panicked:
+		return selfmetrics.TaskPanicked
+	case r.Err != nil:
+		return selfmetrics.TaskFailed
+	default:
+		return selfmetrics.TaskSucceeded
+	}
+}
+
+// job is a task dispatched to a worker along with the context and the collector of the discovery
+type job struct {
+	ctx       context.Context
+	task      ITask
+	collector *Collector
 }
 
 type worker struct {
 	id       string
-	taskChan chan ITask
+	taskChan chan job
 }
 
 func newWorker(id string) *worker {
 	return &worker{
 		id:       id,
-		taskChan: make(chan ITask),
+		taskChan: make(chan job),
 	}
 }
 
-func (w *worker) execute(task ITask) []*data.DIFEntity {
-	return task.Run()
+// execute runs the task of the job within the timeout if it is positive. A panic of the task is recovered
+// and reported as the error of the result. A task that does not return within the grace period after its
+// context is done is abandoned.
+func (w *worker) execute(j job, timeout time.Duration) *Result {
+	ctx := j.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	// Buffered so that an abandoned task does not block forever when it eventually returns
+	done := make(chan *Result, 1)
+	go func() {
+		result := &Result{Task: j.task}
+		defer func() {
+			if r := recover(); r != nil {
+				glog.Errorf("worker %s has recovered from a panic of task %v: %v\n%s",
+					w.id, j.task, r, debug.Stack())
+				result.Entities = nil
+				result.Err = fmt.Errorf("task panicked: %v", r)
+				result.panicked = true
+			}
+			done <- result
+		}()
+		result.Entities, result.Err = j.task.Run(ctx)
+	}()
+	var result *Result
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		select {
+		case result = <-done:
+		case <-time.After(abandonGracePeriod):
+			glog.Errorf("worker %s has abandoned task %v which did not return after %v.",
+				w.id, j.task, ctx.Err())
+			result = &Result{
+				Task:      j.task,
+				Err:       fmt.Errorf("task abandoned: %w", ctx.Err()),
+				Abandoned: true,
+			}
+		}
+	}
+	if result.Err == nil && ctx.Err() != nil {
+		// The task has returned partial results
+		result.Err = fmt.Errorf("task incomplete: %w", ctx.Err())
+	}
+	result.Duration = time.Since(start)
+	selfmetrics.TaskDuration.WithLabelValues(result.status()).Observe(result.Duration.Seconds())
+	return result
 }
@@ -0,0 +1,168 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.ibm.com/turbonomic/turbo-go-sdk/pkg/dataingestionframework/data"
+)
+
+type funcTask func(ctx context.Context) ([]*data.DIFEntity, error)
+
+func (f funcTask) Run(ctx context.Context) ([]*data.DIFEntity, error) {
+	return f(ctx)
+}
+
+func TestExecute(t *testing.T) {
+	w := newWorker("0")
+	entity := &data.DIFEntity{UID: "app"}
+	result := w.execute(job{ctx: context.Background(), task: funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+		return []*data.DIFEntity{entity}, nil
+	})}, time.Minute)
+	assert.Nil(t, result.Err)
+	assert.Equal(t, []*data.DIFEntity{entity}, result.Entities)
+	assert.False(t, result.Abandoned)
+}
+
+func TestExecuteWithPanic(t *testing.T) {
+	w := newWorker("0")
+	result := w.execute(job{ctx: context.Background(), task: funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+		var entity *data.DIFEntity
+		return []*data.DIFEntity{{UID: entity.UID}}, nil
+	})}, 0)
+	assert.NotNil(t, result.Err)
+	assert.Nil(t, result.Entities)
+	assert.False(t, result.Abandoned)
+}
+
+func TestExecuteWithTimeout(t *testing.T) {
+	w := newWorker("0")
+	entity := &data.DIFEntity{UID: "app"}
+	// The task returns its partial results when its context is done
+	result := w.execute(job{ctx: context.Background(), task: funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+		<-ctx.Done()
+		return []*data.DIFEntity{entity}, nil
+	})}, 10*time.Millisecond)
+	assert.True(t, errors.Is(result.Err, context.DeadlineExceeded))
+	assert.Equal(t, []*data.DIFEntity{entity}, result.Entities)
+	assert.False(t, result.Abandoned)
+
+	// The task ignores its context
+	gracePeriod := abandonGracePeriod
+	abandonGracePeriod = 10 * time.Millisecond
+	defer func() { abandonGracePeriod = gracePeriod }()
+	release := make(chan struct{})
+	defer close(release)
+	result = w.execute(job{ctx: context.Background(), task: funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+		<-release
+		return nil, nil
+	})}, 10*time.Millisecond)
+	assert.True(t, errors.Is(result.Err, context.DeadlineExceeded))
+	assert.True(t, result.Abandoned)
+}
+
+func TestDispatcherCollectsAllResults(t *testing.T) {
+	d := NewDispatcher(2)
+	d.Start()
+	tasks := []ITask{
+		funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+			return []*data.DIFEntity{{UID: "app"}}, nil
+		}),
+		funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+			panic("bad task")
+		}),
+		funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+			return nil, errors.New("no query succeeded")
+		}),
+	}
+	collector := NewCollector(len(tasks))
+	go func() {
+		for _, task := range tasks {
+			d.Dispatch(context.Background(), task, collector)
+		}
+	}()
+	results := d.CollectResult(context.Background(), collector, len(tasks))
+	assert.Equal(t, len(tasks), len(results))
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	assert.Equal(t, 2, failed)
+}
+
+// limitedTask is a task whose limits are saturated until it is released
+type limitedTask struct {
+	funcTask
+	saturated *atomic.Bool
+}
+
+func (t limitedTask) Saturated() bool {
+	return t.saturated.Load()
+}
+
+func TestDispatchAllSkipsSaturatedTasks(t *testing.T) {
+	d := NewDispatcher(1)
+	d.Start()
+	var saturated atomic.Bool
+	saturated.Store(true)
+	var lock sync.Mutex
+	var order []string
+	newTask := func(name string) funcTask {
+		return func(ctx context.Context) ([]*data.DIFEntity, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			order = append(order, name)
+			if name == "other" {
+				// The limited server is available again once the other task has completed
+				saturated.Store(false)
+			}
+			return nil, nil
+		}
+	}
+	tasks := []ITask{
+		limitedTask{funcTask: newTask("limited"), saturated: &saturated},
+		newTask("other"),
+		limitedTask{funcTask: newTask("saturated"), saturated: &saturated},
+	}
+	collector := NewCollector(len(tasks))
+	go d.DispatchAll(context.Background(), tasks, collector)
+	results := d.CollectResult(context.Background(), collector, len(tasks))
+	assert.Equal(t, len(tasks), len(results))
+	assert.Equal(t, []string{"other", "limited", "saturated"}, order)
+}
+
+func TestConcurrentDiscoveries(t *testing.T) {
+	d := NewDispatcher(2)
+	d.Start()
+	discover := func(uid string, count int) []*Result {
+		collector := NewCollector(count)
+		go func() {
+			for i := 0; i < count; i++ {
+				d.Dispatch(context.Background(), funcTask(func(ctx context.Context) ([]*data.DIFEntity, error) {
+					time.Sleep(time.Millisecond)
+					return []*data.DIFEntity{{UID: uid}}, nil
+				}), collector)
+			}
+		}()
+		return d.CollectResult(context.Background(), collector, count)
+	}
+	done := make(chan []*Result)
+	go func() { done <- discover("first", 10) }()
+	second := discover("second", 5)
+	first := <-done
+	assert.Equal(t, 10, len(first))
+	for _, result := range first {
+		assert.Equal(t, "first", result.Entities[0].UID)
+	}
+	assert.Equal(t, 5, len(second))
+	for _, result := range second {
+		assert.Equal(t, "second", result.Entities[0].UID)
+	}
+}